@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func getApiRouter() *http.ServeMux {
+	router := http.NewServeMux()
+	router.Handle("/metrics", promhttp.Handler())
+	router.HandleFunc("/health/live", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(map[string]bool{"alive": true})
+	})
+	router.HandleFunc("/health/ready", func(writer http.ResponseWriter, request *http.Request) {
+		report := GetHealthReport()
+		writer.Header().Set("Content-Type", "application/json")
+		if !report.Ready {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(writer).Encode(report)
+	})
+	return router
+}
+
+func StartApiServer() (server *http.Server) {
+	server = &http.Server{Addr: ":" + util.Config.ApiPort, Handler: getApiRouter()}
+	go func() {
+		log.Println("start api server on", server.Addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal("error in api server: ", err)
+		}
+	}()
+	return server
+}
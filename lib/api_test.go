@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl}
+	api := httptest.NewServer(getApiRouter())
+	defer api.Close()
+
+	completed := testutil.ToFloat64(TasksCompleted.WithLabelValues("metrics"))
+	failed := testutil.ToFloat64(TasksFailed.WithLabelValues("metrics", ErrorClassProtocolError))
+	roundTrips := responseRoundTripCount(t, "metrics")
+
+	for _, id := range []string{"task1", "task2"} {
+		task := messages.CamundaTask{Id: id, TopicName: "metrics"}
+		engine.Lock(task, GetWorkerId())
+		GetInFlightRegistry().Add(InFlightTask{Task: task, WorkerId: GetWorkerId(), Service: model.Service{Id: "service1"}, OutputName: CAMUNDA_OUTPUT_NAME, SendTime: time.Now()})
+	}
+	for id, errMsg := range map[string]string{"task1": "", "task2": "device offline"} {
+		msg, _ := json.Marshal(messages.ProtocolMsg{WorkerId: GetWorkerId(), TaskId: id, OutputName: CAMUNDA_OUTPUT_NAME, Error: errMsg})
+		if err := CompleteCamundaTask(string(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if testutil.ToFloat64(TasksCompleted.WithLabelValues("metrics")) != completed+1 {
+		t.Fatal("completion not counted")
+	}
+	if testutil.ToFloat64(TasksFailed.WithLabelValues("metrics", ErrorClassProtocolError)) != failed+1 {
+		t.Fatal("failure not counted")
+	}
+	if responseRoundTripCount(t, "metrics") != roundTrips+1 {
+		t.Fatal("round trip not observed")
+	}
+
+	resp, err := http.Get(api.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, metric := range []string{
+		`external_task_worker_tasks_completed_total{topic="metrics"}`,
+		`external_task_worker_tasks_failed_total{error_class="protocol_error",topic="metrics"}`,
+		`external_task_worker_response_round_trip_seconds_count{topic="metrics"}`,
+		`external_task_worker_responses_total{result="accepted"}`,
+		`external_task_worker_tasks_in_flight`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Fatal("missing metric", metric)
+		}
+	}
+}
+
+//number of observations of ResponseRoundTrip for topic
+func responseRoundTripCount(t *testing.T, topic string) uint64 {
+	resp := httptest.NewRecorder()
+	getApiRouter().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	prefix := `external_task_worker_response_round_trip_seconds_count{topic="` + topic + `"} `
+	for _, line := range strings.Split(resp.Body.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			count, err := strconv.ParseUint(strings.TrimPrefix(line, prefix), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return count
+		}
+	}
+	return 0
+}
+
+func TestHealthReady(t *testing.T) {
+	healthMux.Lock()
+	healthChecks = map[string]HealthCheck{}
+	healthMux.Unlock()
+	defer func() {
+		healthMux.Lock()
+		healthChecks = map[string]HealthCheck{}
+		healthMux.Unlock()
+	}()
+	api := httptest.NewServer(getApiRouter())
+	defer api.Close()
+	ready := func() (status int, report HealthReport) {
+		resp, err := http.Get(api.URL + "/health/ready")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err = json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, report
+	}
+
+	ReportHealth(HealthCamunda, true, nil)
+	ReportHealth(HealthKeycloak, false, errors.New("keycloak down"))
+	if status, report := ready(); status != http.StatusOK || !report.Ready || report.Checks[HealthKeycloak].Ok {
+		t.Fatal("non critical check should not affect readiness", status, report)
+	}
+	ReportHealth(HealthCamunda, true, errors.New("camunda down"))
+	if status, report := ready(); status != http.StatusServiceUnavailable || report.Ready || report.Checks[HealthCamunda].Error != "camunda down" {
+		t.Fatal("critical check should affect readiness", status, report)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"errors"
 	"github.com/coocood/freecache"
 	"log"
+	"strings"
 )
 
 var L1Expiration = 60          // 60sec
@@ -46,13 +47,44 @@ func (this *Cache) Get(key string) (item Item, err error) {
 	if err != nil && err != freecache.ErrNotFound {
 		log.Println("ERROR: in Cache::l1.Get()", err)
 	}
+	if err == nil {
+		CacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		CacheRequests.WithLabelValues("miss").Inc()
+	}
 	return
 }
 
+//expiration in seconds; values <= 0 use L1Expiration (results that should not be cached are not passed to Set)
 func (this *Cache) Set(key string, value []byte, expiration int32) {
-	err := this.l1.Set([]byte(key), value, L1Expiration)
+	if expiration <= 0 {
+		expiration = int32(L1Expiration)
+	}
+	err := this.l1.Set([]byte(key), value, int(expiration))
 	if err != nil {
 		log.Println("ERROR: in Cache::l1.Set()", err)
 	}
 	return
 }
+
+func (this *Cache) Del(key string) {
+	this.l1.Del([]byte(key))
+}
+
+//deletes all keys with the given prefix and suffix; iterates the whole cache and should only be used for rare events
+func (this *Cache) DelMatching(prefix string, suffix string) (count int) {
+	keys := [][]byte{}
+	iterator := this.l1.NewIterator()
+	for entry := iterator.Next(); entry != nil; entry = iterator.Next() {
+		key := string(entry.Key)
+		if strings.HasPrefix(key, prefix) && strings.HasSuffix(key, suffix) && len(key) >= len(prefix)+len(suffix) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	for _, key := range keys {
+		if this.l1.Del(key) {
+			count++
+		}
+	}
+	return
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+//common fields of device, service and permission change events
+type CacheInvalidationMsg struct {
+	Command  string `json:"command"`
+	Id       string `json:"id"`
+	Kind     string `json:"kind"`
+	Resource string `json:"resource"`
+}
+
+func HandleDeviceChange(iot *Iot, msg CacheInvalidationMsg) {
+	if msg.Id != "" {
+		iot.InvalidateDevice(msg.Id)
+	}
+}
+
+func HandleServiceChange(iot *Iot, msg CacheInvalidationMsg) {
+	if msg.Id != "" {
+		iot.InvalidateService(msg.Id)
+	}
+}
+
+func HandlePermissionChange(iot *Iot, msg CacheInvalidationMsg) {
+	if msg.Kind != "" && msg.Kind != "deviceinstance" {
+		return
+	}
+	if msg.Resource != "" {
+		iot.InvalidateDeviceAccess(msg.Resource)
+	}
+}
+
+//interval in which new partitions of the change topics are looked up
+var cacheInvalidationPartitionRefresh = time.Minute
+
+//every worker instance has its own cache; so every instance reads all partitions instead of joining a consumer group
+//reconnects with the kafka reconnect backoff until ctx is done
+func InitCacheInvalidation(ctx context.Context) {
+	handler := map[string]func(iot *Iot, msg CacheInvalidationMsg){}
+	if util.Config.DeviceChangeTopic != "" {
+		handler[util.Config.DeviceChangeTopic] = HandleDeviceChange
+	}
+	if util.Config.ServiceChangeTopic != "" {
+		handler[util.Config.ServiceChangeTopic] = HandleServiceChange
+	}
+	if util.Config.PermissionChangeTopic != "" {
+		handler[util.Config.PermissionChangeTopic] = HandlePermissionChange
+	}
+	if len(handler) == 0 {
+		return
+	}
+	runCacheInvalidation(ctx, GetIot(), handler)
+}
+
+func runCacheInvalidation(ctx context.Context, iot *Iot, handler map[string]func(iot *Iot, msg CacheInvalidationMsg)) {
+	backoff := NewKafkaReconnectBackoff()
+	for {
+		start := time.Now()
+		err := consumeCacheInvalidation(ctx, iot, handler)
+		if err == nil {
+			return
+		}
+		log.Println("ERROR: cache invalidation", err)
+		ReportHealth(HealthCacheInvalidation, false, err)
+		if GetKafkaErrorPolicy() == KafkaErrorsFatal {
+			log.Fatal("cache invalidation error: ", err)
+		}
+		if time.Since(start) > backoff.Max {
+			backoff.Reset()
+		}
+		wait := backoff.Next()
+		log.Println("reconnect cache invalidation in", wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+//returns nil if ctx is done; an error if the consumer should reconnect
+func consumeCacheInvalidation(ctx context.Context, iot *Iot, handler map[string]func(iot *Iot, msg CacheInvalidationMsg)) (err error) {
+	broker, err := GetBrokerList()
+	if err != nil {
+		return err
+	}
+	sarama_conf, err := NewKafkaConsumerConfig(sarama.V0_10_0_1)
+	if err != nil {
+		return err
+	}
+	sarama_conf.Consumer.Return.Errors = GetKafkaErrorPolicy() != KafkaErrorsIgnore
+	client, err := sarama.NewClient(broker, sarama_conf)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	errs := make(chan error, 1)
+	partitionConsumers := map[string]map[int32]sarama.PartitionConsumer{}
+	defer func() {
+		for _, partitions := range partitionConsumers {
+			for _, partitionConsumer := range partitions {
+				partitionConsumer.AsyncClose()
+			}
+		}
+	}()
+	//partitions found on startup start at the newest offset; partitions added later are read from the beginning
+	consumeNewPartitions := func(offset int64) error {
+		for topic, topicHandler := range handler {
+			err := client.RefreshMetadata(topic)
+			if err != nil {
+				return err
+			}
+			partitions, err := client.Partitions(topic)
+			if err != nil {
+				return err
+			}
+			if partitionConsumers[topic] == nil {
+				partitionConsumers[topic] = map[int32]sarama.PartitionConsumer{}
+			}
+			for _, partition := range partitions {
+				if _, ok := partitionConsumers[topic][partition]; ok {
+					continue
+				}
+				partitionConsumer, err := consumer.ConsumePartition(topic, partition, offset)
+				if err != nil {
+					return err
+				}
+				partitionConsumers[topic][partition] = partitionConsumer
+				go consumeCacheInvalidationPartition(partitionConsumer, iot, topicHandler, errs)
+			}
+		}
+		return nil
+	}
+	err = consumeNewPartitions(sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	ReportHealth(HealthCacheInvalidation, false, nil)
+
+	refresh := time.NewTicker(cacheInvalidationPartitionRefresh)
+	defer refresh.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stop cache invalidation")
+			return nil
+		case err = <-errs:
+			return err
+		case <-refresh.C:
+			err = consumeNewPartitions(sarama.OffsetOldest)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func consumeCacheInvalidationPartition(consumer sarama.PartitionConsumer, iot *Iot, handler func(iot *Iot, msg CacheInvalidationMsg), errs chan<- error) {
+	for {
+		select {
+		case err, ok := <-consumer.Errors():
+			if !ok {
+				return
+			}
+			select {
+			case errs <- err:
+			default:
+			}
+		case msg, ok := <-consumer.Messages():
+			if !ok {
+				return
+			}
+			invalidation := CacheInvalidationMsg{}
+			err := json.Unmarshal(msg.Value, &invalidation)
+			if err != nil {
+				log.Println("ERROR: unable to parse cache invalidation message", err, string(msg.Value))
+				continue
+			}
+			handler(iot, invalidation)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+func TestCacheInvalidationConsumer(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	//the change topic does not exist yet
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+	util.Config = &util.ConfigStruct{KafkaBootstrap: broker.Addr(), KafkaReconnectBackoff: 50, KafkaReconnectMaxBackoff: 50}
+	defaultRefresh := cacheInvalidationPartitionRefresh
+	cacheInvalidationPartitionRefresh = 100 * time.Millisecond
+	defer func() { cacheInvalidationPartitionRefresh = defaultRefresh }()
+	changes := make(chan CacheInvalidationMsg, 10)
+	handler := map[string]func(iot *Iot, msg CacheInvalidationMsg){
+		"service": func(iot *Iot, msg CacheInvalidationMsg) {
+			changes <- msg
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		runCacheInvalidation(ctx, NewIot(""), handler)
+		close(done)
+	}()
+	waitForCacheInvalidationHealth(t, false)
+
+	//reconnect once the topic is available
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("service", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("service", 0, sarama.OffsetOldest, 0).
+			SetOffset("service", 0, sarama.OffsetNewest, 0).
+			SetOffset("service", 1, sarama.OffsetOldest, 0).
+			SetOffset("service", 1, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(2).
+			SetMessage("service", 1, 0, sarama.StringEncoder(`{"command":"PUT","id":"service1"}`)),
+	})
+	waitForCacheInvalidationHealth(t, true)
+	select {
+	case msg := <-changes:
+		t.Fatal("unexpected change", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	//partitions added later are consumed from the beginning
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("service", 0, broker.BrokerID()).
+			SetLeader("service", 1, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("service", 0, sarama.OffsetOldest, 0).
+			SetOffset("service", 0, sarama.OffsetNewest, 0).
+			SetOffset("service", 1, sarama.OffsetOldest, 0).
+			SetOffset("service", 1, sarama.OffsetNewest, 1),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(2).
+			SetMessage("service", 1, 0, sarama.StringEncoder(`{"command":"PUT","id":"service1"}`)),
+	})
+	select {
+	case msg := <-changes:
+		if msg.Id != "service1" {
+			t.Fatal(msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("change of new partition not consumed")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache invalidation not stopped")
+	}
+}
+
+func waitForCacheInvalidationHealth(t *testing.T, ok bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		check, reported := GetHealthReport().Checks[HealthCacheInvalidation]
+		if reported && check.Ok == ok {
+			if check.Critical {
+				t.Fatal("cache invalidation should not affect readiness")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected cache invalidation health", ok, check)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -17,6 +17,7 @@
 package lib
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -32,12 +33,15 @@ import (
 	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
 	"github.com/SENERGY-Platform/formatter-lib"
 	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+	"github.com/satori/go.uuid"
 )
 
 const CAMUNDA_VARIABLES_PAYLOAD = "payload"
+const CAMUNDA_OUTPUT_NAME = "result"
+const CAMUNDA_VARIABLES_COMMAND_SENT = "command_sent"
 
-func ExecuteNextCamundaTask() (wait bool) {
-	tasks, err := GetCamundaTask()
+func ExecuteNextCamundaTask(ctx context.Context) (wait bool) {
+	tasks, err := GetCamundaTask(ctx)
 	if err != nil {
 		log.Println("error on ExecuteNextCamundaTask getTask", err)
 		return true
@@ -45,12 +49,15 @@ func ExecuteNextCamundaTask() (wait bool) {
 	if len(tasks) == 0 {
 		return true
 	}
+	lockTime := time.Now()
 	wg := sync.WaitGroup{}
 	for _, task := range tasks {
+		task.LockTime = lockTime
+		TasksFetched.WithLabelValues(task.TopicName).Inc()
 		wg.Add(1)
 		go func(asyncTask messages.CamundaTask) {
 			defer wg.Done()
-			ExecuteCamundaTask(asyncTask)
+			HandleCamundaTask(asyncTask)
 		}(task)
 	}
 	wg.Wait()
@@ -211,27 +218,78 @@ func ExecuteCamundaTask(task messages.CamundaTask) {
 	if task.Error != "" {
 		log.Println("WARNING: existing failure in camunda task", task.Error)
 	}
-	if util.Config.QosStrategy == "<=" && task.Retries == 1 {
-		CamundaError(task, "communication timeout")
-		return
+	if util.Config.QosStrategy == "<=" {
+		sent := GetInFlightRegistry().TakeUnanswered(task.Id)
+		if !sent {
+			var err error
+			sent, err = IsCommandSent(task)
+			if err != nil {
+				log.Println("ERROR: unable to check if the command has been sent", task.Id, err)
+				HandleTaskError(task, NewTaskError(ErrorClassUnavailable, "unable to check if the command has been sent: "+err.Error()))
+				return
+			}
+		}
+		if sent {
+			HandleTaskError(task, NewFinalTaskError(ErrorClassTimeout, "communication timeout"))
+			return
+		}
 	}
 	request, err := ToBpmnRequest(task)
 	if err != nil {
 		log.Println("error on ToBpmnRequest(): ", err)
-		CamundaError(task, "invalid task format (json)")
+		HandleTaskError(task, NewTaskError(ErrorClassInvalidPayload, "invalid task format (json)"))
 		return
 	}
 
-	protocolTopic, message, err := createKafkaCommandMessage(request, task)
+	command, instance, service, err := createKafkaCommandMessage(request, task)
 	if err != nil {
 		log.Println("error on ExecuteCamundaTask createKafkaCommandMessage", err)
-		CamundaError(task, err.Error())
+		HandleTaskError(task, err)
 		return
 	}
-	if util.Config.QosStrategy == "<=" && task.Retries != 1 {
-		SetCamundaRetry(task.Id)
+	if util.Config.QosStrategy == "<=" {
+		err = MarkCommandSent(task)
+		if err != nil {
+			log.Println("ERROR: unable to mark the command as sent", task.Id, err)
+			HandleTaskError(task, NewTaskError(ErrorClassUnavailable, "unable to mark the command as sent: "+err.Error()))
+			return
+		}
+	}
+	if IsHttpProtocolHandler(command.Topic) {
+		ExecuteHttpCommand(task, command, service)
+		return
 	}
-	Produce(protocolTopic, message)
+	now := time.Now()
+	GetInFlightRegistry().Add(InFlightTask{
+		Task:         task,
+		WorkerId:     GetWorkerId(),
+		Device:       instance,
+		Service:      service,
+		OutputName:   CAMUNDA_OUTPUT_NAME,
+		LockDuration: getLockDuration(task),
+		SendTime:     now,
+		Deadline:     now.Add(getMaxResponseTime()),
+		TraceId:      command.Headers[HeaderTraceId],
+	})
+	err = GetTransport().Publish(task.Id, command)
+	if err != nil {
+		GetInFlightRegistry().Close(task.Id)
+		if util.Config.QosStrategy == "<=" {
+			if err := UnmarkCommandSent(task); err != nil {
+				log.Println("ERROR: unable to reset the sent marker", task.Id, err)
+			}
+		}
+		HandleTaskError(task, NewTaskError(ErrorClassUnavailable, "unable to send command: "+err.Error()))
+		return
+	}
+	log.Println("send command", task.Id, HeaderTraceId, command.Headers[HeaderTraceId])
+}
+
+func getLockDuration(task messages.CamundaTask) int64 {
+	if topic, ok := GetTopic(task.TopicName); ok {
+		return topic.LockDuration
+	}
+	return util.Config.CamundaFetchLockDuration
 }
 
 type Envelope struct {
@@ -250,11 +308,52 @@ func (envelope Envelope) Validate() error {
 	return nil
 }
 
-func createKafkaCommandMessage(request messages.BpmnMsg, task messages.CamundaTask) (protocolTopic string, message string, err error) {
-	instance, service, err := GetDeviceInfo(request.InstanceId, request.ServiceId, task.TenantId)
+//kafka message for the protocol handler
+type CommandMessage struct {
+	Topic   string //protocol topic; url of http protocol handlers
+	Key     string //empty = no key
+	Headers map[string]string
+	Value   string
+}
+
+const (
+	HeaderTaskId            = "task_id"
+	HeaderProcessInstanceId = "process_instance_id"
+	HeaderTenantId          = "tenant_id"
+	HeaderWorkerId          = "worker_id"
+	HeaderTraceId           = "trace_id"
+)
+
+const (
+	MessageKeyDevice  = "device"
+	MessageKeyService = "service"
+	MessageKeyNone    = "none"
+)
+
+//KafkaMessageKey; commands with the same key are sent to the same partition and are handled in order
+func getCommandKey(instance model.DeviceInstance, service model.Service) string {
+	switch util.Config.KafkaMessageKey {
+	case MessageKeyService:
+		return service.Id
+	case MessageKeyNone:
+		return ""
+	default:
+		return instance.Id
+	}
+}
+
+func createKafkaCommandMessage(request messages.BpmnMsg, task messages.CamundaTask) (command CommandMessage, instance model.DeviceInstance, service model.Service, err error) {
+	instance, service, err = GetDeviceInfo(request.InstanceId, request.ServiceId, task.TenantId)
 	if err != nil {
 		log.Println("error on createKafkaCommandMessage getDeviceInfo: ", err)
-		err = errors.New("unable to find device or service")
+		switch err {
+		case ErrResourceNotFound:
+			err = NewTaskError(ErrorClassUnknownDevice, "unable to find device or service")
+		case ErrAccessDenied:
+			err = NewTaskError(ErrorClassAccessDenied, err.Error())
+		default:
+			err = NewTaskError(ErrorClassUnavailable, "unable to find device or service")
+		}
 		return
 	}
 	value, err := createMessageForProtocolHandler(instance, service, request.Inputs, task)
@@ -263,7 +362,7 @@ func createKafkaCommandMessage(request messages.BpmnMsg, task messages.CamundaTa
 		err = errors.New("internal format error (inconsistent data?) (time: " + time.Now().String() + ")")
 		return
 	}
-	protocolTopic = service.Protocol.ProtocolHandlerUrl
+	protocolTopic := service.Protocol.ProtocolHandlerUrl
 	if protocolTopic == "" {
 		log.Println("ERROR: empty protocol topic")
 		log.Println("DEBUG: ", instance, service)
@@ -271,11 +370,23 @@ func createKafkaCommandMessage(request messages.BpmnMsg, task messages.CamundaTa
 		return
 	}
 	envelope := Envelope{ServiceId: service.Id, DeviceId: instance.Id, Value: value}
-	if err := envelope.Validate(); err != nil {
-		return protocolTopic, message, err
+	if err = envelope.Validate(); err != nil {
+		return
 	}
 	msg, err := json.Marshal(envelope)
-	return protocolTopic, string(msg), err
+	command = CommandMessage{
+		Topic: protocolTopic,
+		Key:   getCommandKey(instance, service),
+		Headers: map[string]string{
+			HeaderTaskId:            task.Id,
+			HeaderProcessInstanceId: task.ProcessInstanceId,
+			HeaderTenantId:          task.TenantId,
+			HeaderWorkerId:          GetWorkerId(),
+			HeaderTraceId:           uuid.NewV4().String(),
+		},
+		Value: string(msg),
+	}
+	return command, instance, service, err
 }
 
 func createMessageForProtocolHandler(instance model.DeviceInstance, service model.Service, inputs map[string]interface{}, task messages.CamundaTask) (result messages.ProtocolMsg, err error) {
@@ -286,7 +397,7 @@ func createMessageForProtocolHandler(instance model.DeviceInstance, service mode
 		TaskId:           task.Id,
 		DeviceInstanceId: instance.Id,
 		ServiceId:        service.Id,
-		OutputName:       "result", //task.ActivityId,
+		OutputName:       CAMUNDA_OUTPUT_NAME, //task.ActivityId,
 		Time:             strconv.FormatInt(time.Now().Unix(), 10),
 		Service:          service,
 	}
@@ -315,23 +426,138 @@ func createMessageForProtocolHandler(instance model.DeviceInstance, service mode
 	return
 }
 
+//the response can not be processed, regardless of retries; see PublishDeadLetter
+type InvalidResponseError struct {
+	Err error
+}
+
+func (this InvalidResponseError) Error() string {
+	return "invalid response: " + this.Err.Error()
+}
+
 func CompleteCamundaTask(msg string) (err error) {
 	var nrMsg messages.ProtocolMsg
 	err = json.Unmarshal([]byte(msg), &nrMsg)
 	if err != nil {
+		return InvalidResponseError{Err: err}
+	}
+	inFlightTask, ok, err := resolveInFlightTask(nrMsg)
+	if err != nil || !ok {
 		return err
 	}
-	if util.Config.QosStrategy == ">=" && missesCamundaDuration(nrMsg) {
-		return
+	err = completeResponse(nrMsg, inFlightTask)
+	if _, invalid := err.(InvalidResponseError); err != nil && !invalid && nrMsg.WorkerId == GetWorkerId() {
+		//the response will be delivered again and has to find its task
+		GetInFlightRegistry().Add(inFlightTask)
 	}
-	response, err := createBpmnResponse(nrMsg)
+	return err
+}
+
+//completes a response of the dead letter topic; its in-flight task is usually gone, so the task is loaded from camunda
+func ReplayResponse(msg string) (err error) {
+	var nrMsg messages.ProtocolMsg
+	err = json.Unmarshal([]byte(msg), &nrMsg)
 	if err != nil {
-		return err
+		return InvalidResponseError{Err: err}
+	}
+	inFlightTask, err := GetInFlightRegistry().Resolve(nrMsg.TaskId)
+	if err != nil {
+		var ok bool
+		inFlightTask, ok, err = loadResponseTask(nrMsg)
+		if err != nil || !ok {
+			return err
+		}
+	}
+	return completeResponse(nrMsg, inFlightTask)
+}
+
+func completeResponse(nrMsg messages.ProtocolMsg, inFlightTask InFlightTask) (err error) {
+	if nrMsg.Error != "" {
+		HandleTaskError(inFlightTask.Task, NewTaskError(ErrorClassProtocolError, nrMsg.Error))
+		return nil
+	}
+	response, err := createBpmnResponse(nrMsg, inFlightTask.Service)
+	if err != nil {
+		return InvalidResponseError{Err: err}
+	}
+	err = completeCamundaTask(inFlightTask.Task, inFlightTask.WorkerId, inFlightTask.OutputName, response)
+	if err == nil && inFlightTask.TraceId != "" {
+		log.Println("completed command", inFlightTask.Task.Id, HeaderTraceId, inFlightTask.TraceId)
+	}
+	if err == nil && !inFlightTask.SendTime.IsZero() {
+		ResponseRoundTrip.WithLabelValues(inFlightTask.Task.TopicName).Observe(time.Since(inFlightTask.SendTime).Seconds())
 	}
-	err = completeCamundaTask(nrMsg.TaskId, nrMsg.WorkerId, nrMsg.OutputName, response)
 	return
 }
 
+//returns the in-flight task of the response; ok is false if the response should be dropped
+//replicas share the response consumer group, so responses of other worker instances are verified with camunda (see loadResponseTask)
+//unless AcceptForeignResponses is "false"
+func resolveInFlightTask(nrMsg messages.ProtocolMsg) (task InFlightTask, ok bool, err error) {
+	registry := GetInFlightRegistry()
+	if nrMsg.WorkerId != GetWorkerId() {
+		registry.CountForeign()
+		if util.Config.AcceptForeignResponses == "false" {
+			log.Println("WARNING: drop response of other worker", nrMsg.WorkerId, nrMsg.TaskId)
+			registry.CountForeignDropped()
+			return task, false, nil
+		}
+		if util.Config.QosStrategy == ">=" && missesCamundaDuration(nrMsg) {
+			registry.CountForeignDropped()
+			return task, false, nil
+		}
+		task, ok, err = loadResponseTask(nrMsg)
+		if err == nil && !ok {
+			registry.CountForeignDropped()
+		}
+		return task, ok, err
+	}
+	task, err = registry.Resolve(nrMsg.TaskId)
+	if err != nil {
+		log.Println("WARNING: drop response", nrMsg.TaskId, err)
+		return task, false, nil
+	}
+	return task, true, nil
+}
+
+//task of a response without in-flight task; ok is false if the response should be dropped
+//the echoed worker id has to own the lock of the camunda task; the service is resolved from the payload of the task, not from the response
+func loadResponseTask(nrMsg messages.ProtocolMsg) (task InFlightTask, ok bool, err error) {
+	camundaTask, err := GetCamundaTaskById(nrMsg.TaskId)
+	if IsCamundaTaskGone(err) {
+		log.Println("WARNING: drop response; camunda task is gone", nrMsg.TaskId, err)
+		return task, false, nil
+	}
+	if err != nil {
+		return task, false, err
+	}
+	if camundaTask.WorkerId == "" || camundaTask.WorkerId != nrMsg.WorkerId {
+		log.Println("WARNING: drop response; camunda task is not locked by the worker of the response", nrMsg.TaskId, nrMsg.WorkerId, camundaTask.WorkerId)
+		return task, false, nil
+	}
+	payload, err := GetCamundaClient().Variable(camundaTask, CAMUNDA_VARIABLES_PAYLOAD)
+	if IsCamundaTaskNotFound(err) {
+		log.Println("WARNING: drop response; missing payload of camunda task", nrMsg.TaskId, err)
+		return task, false, nil
+	}
+	if err != nil {
+		return task, false, err
+	}
+	camundaTask.Variables = map[string]messages.CamundaVariable{CAMUNDA_VARIABLES_PAYLOAD: payload}
+	request, err := ToBpmnRequest(camundaTask)
+	if err != nil {
+		return task, false, InvalidResponseError{Err: err}
+	}
+	_, service, err := GetDeviceInfo(request.InstanceId, request.ServiceId, camundaTask.TenantId)
+	if err == ErrResourceNotFound || err == ErrAccessDenied {
+		return task, false, InvalidResponseError{Err: err}
+	}
+	if err != nil {
+		return task, false, err
+	}
+	return InFlightTask{Task: camundaTask, WorkerId: camundaTask.WorkerId, Service: service, OutputName: CAMUNDA_OUTPUT_NAME}, true, nil
+}
+
 func missesCamundaDuration(msg messages.ProtocolMsg) bool {
 	if msg.Time == "" {
 		return true
@@ -341,13 +567,12 @@ func missesCamundaDuration(msg messages.ProtocolMsg) bool {
 		return true
 	}
 	taskTime := time.Unix(unixTime, 0)
-	return time.Since(taskTime) >= time.Duration(util.Config.CamundaFetchLockDuration)*time.Millisecond
+	return time.Since(taskTime) >= getMaxResponseTime()
 }
 
-func createBpmnResponse(nrMsg messages.ProtocolMsg) (result messages.BpmnMsg, err error) {
+func createBpmnResponse(nrMsg messages.ProtocolMsg, service model.Service) (result messages.BpmnMsg, err error) {
 	result.Outputs = map[string]interface{}{}
-	result.ServiceId = nrMsg.ServiceId
-	service := nrMsg.Service
+	result.ServiceId = service.Id
 	for _, output := range nrMsg.ProtocolParts {
 		for _, serviceOutput := range service.Output {
 			if serviceOutput.MsgSegment.Name == output.Name {
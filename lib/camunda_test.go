@@ -0,0 +1,272 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+)
+
+func TestCreateKafkaCommandMessage(t *testing.T) {
+	drcloser, deviceRepoUrl, _ := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, _ := PermsearchMock()
+	defer permcloser()
+
+	request := messages.BpmnMsg{InstanceId: "device1", ServiceId: "service1"}
+	task := messages.CamundaTask{Id: "task1", ProcessInstanceId: "process1", TenantId: "user1"}
+	expectedKeys := map[string]string{"": "device1", MessageKeyDevice: "device1", MessageKeyService: "service1", MessageKeyNone: ""}
+	for keyConfig, expectedKey := range expectedKeys {
+		util.Config = &util.ConfigStruct{DeviceRepoUrl: deviceRepoUrl, AuthEndpoint: authUrl, PermissionsUrl: permUrl, KafkaMessageKey: keyConfig}
+		command, _, _, err := createKafkaCommandMessage(request, task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command.Topic != "protocol1" || command.Key != expectedKey {
+			t.Fatal(keyConfig, command)
+		}
+		if command.Headers[HeaderTaskId] != "task1" ||
+			command.Headers[HeaderProcessInstanceId] != "process1" ||
+			command.Headers[HeaderTenantId] != "user1" ||
+			command.Headers[HeaderWorkerId] != GetWorkerId() ||
+			command.Headers[HeaderTraceId] == "" {
+			t.Fatal(command.Headers)
+		}
+	}
+}
+
+func TestExecuteCamundaTask(t *testing.T) {
+	drcloser, deviceRepoUrl, _ := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, _ := PermsearchMock()
+	defer permcloser()
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+
+	util.Config = &util.ConfigStruct{
+		CamundaUrl:               camundaUrl,
+		CamundaTopic:             "command",
+		CamundaFetchLockDuration: 60000,
+		CamundaWorkerTasks:       10,
+		DeviceRepoUrl:            deviceRepoUrl,
+		AuthEndpoint:             authUrl,
+		PermissionsUrl:           permUrl,
+		QosStrategy:              "<=",
+	}
+	memory := NewMemoryTransport(nil)
+	SetTransport(memory)
+	defer SetTransport(KafkaTransport{})
+	defer UnregisterTopic("command")
+	RegisterDeviceCommandTopic()
+
+	engine.Queue(
+		testCommandTask("task1", "device1"),
+		testCommandTask("task2", "unknown"),
+		messages.CamundaTask{Id: "task3", TopicName: "command", TenantId: "user1"},
+	)
+	ExecuteNextCamundaTask(context.Background())
+	defer GetInFlightRegistry().Close("task1")
+
+	published := memory.Published()
+	if len(published) != 1 || published[0].Headers[HeaderTaskId] != "task1" {
+		t.Fatal(published)
+	}
+	if _, ok := GetInFlightRegistry().Get("task1"); !ok {
+		t.Fatal("missing in-flight task1")
+	}
+	if _, ok := engine.Retries("task1"); ok {
+		t.Fatal("the retries of task1 must not be touched by the qos strategy")
+	}
+	if !engine.Locked("task1") {
+		t.Fatal("task1 should wait for its response")
+	}
+	if _, ok := engine.Failure("task2"); !ok {
+		t.Fatal("missing failure of task2 (unknown device)")
+	}
+	if _, ok := engine.Failure("task3"); !ok {
+		t.Fatal("missing failure of task3 (missing payload)")
+	}
+
+	//lock of task1 expired without response: camunda hands it out again, the command may not be sent twice
+	GetInFlightRegistry().Expire("task1")
+	engine.Queue(testCommandTask("task1", "device1"))
+	ExecuteNextCamundaTask(context.Background())
+	if len(memory.Published()) != 1 {
+		t.Fatal("command of task1 sent twice", memory.Published())
+	}
+	failure, ok := engine.Failure("task1")
+	if !ok || failure.Retries != 0 {
+		t.Fatal("missing final timeout failure of task1", failure)
+	}
+
+	//the marker in camunda holds for other workers and after a restart without in-flight store
+	engine.Queue(testCommandTask("task4", "device1"))
+	ExecuteNextCamundaTask(context.Background())
+	if marker, ok := engine.LocalVariable("execution-task4", CAMUNDA_VARIABLES_COMMAND_SENT); !ok || marker.Value != "task4" || len(memory.Published()) != 2 {
+		t.Fatal("missing sent marker of task4", marker, memory.Published())
+	}
+	GetInFlightRegistry().Close("task4")
+	engine.Queue(testCommandTask("task4", "device1"))
+	ExecuteNextCamundaTask(context.Background())
+	if len(memory.Published()) != 2 {
+		t.Fatal("command of task4 sent twice", memory.Published())
+	}
+	if failure, ok := engine.Failure("task4"); !ok || failure.Retries != 0 {
+		t.Fatal("missing final timeout failure of task4", failure)
+	}
+
+	//a marker of an earlier task of the same execution is ignored
+	task5 := testCommandTask("task5", "device1")
+	task5.ExecutionId = "execution-task4"
+	engine.Queue(task5)
+	ExecuteNextCamundaTask(context.Background())
+	defer GetInFlightRegistry().Close("task5")
+	if len(memory.Published()) != 3 {
+		t.Fatal("command of task5 not sent", memory.Published())
+	}
+}
+
+func TestCompleteCamundaTask(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl, CamundaFetchLockDuration: 60000}
+
+	for _, task := range []messages.CamundaTask{{Id: "task1"}, {Id: "task2"}, {Id: "task4"}} {
+		GetInFlightRegistry().Add(InFlightTask{Task: task, WorkerId: GetWorkerId(), Service: model.Service{Id: "service1"}, OutputName: CAMUNDA_OUTPUT_NAME})
+		defer GetInFlightRegistry().Close(task.Id)
+	}
+	engine.Lock(messages.CamundaTask{Id: "task1"}, GetWorkerId())
+	engine.Lock(messages.CamundaTask{Id: "task2"}, "other-worker")
+	engine.Lock(messages.CamundaTask{Id: "task4"}, GetWorkerId())
+
+	response := func(taskId string, errMsg string) string {
+		msg, _ := json.Marshal(messages.ProtocolMsg{WorkerId: GetWorkerId(), TaskId: taskId, OutputName: CAMUNDA_OUTPUT_NAME, Error: errMsg})
+		return string(msg)
+	}
+	err := CompleteCamundaTask(response("task1", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	completion, ok := engine.Completion("task1")
+	if !ok || completion.WorkerId != GetWorkerId() || completion.Variables[CAMUNDA_OUTPUT_NAME].Value.ServiceId != "service1" {
+		t.Fatal(completion)
+	}
+
+	//lock lost: the response is dropped
+	err = CompleteCamundaTask(response("task2", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := engine.Completion("task2"); ok || engine.Get("/external-task/task2/failure") != 0 {
+		t.Fatal("unexpected handling of task2")
+	}
+
+	//unknown task: dropped
+	err = CompleteCamundaTask(response("task3", ""))
+	if err != nil || engine.Get("/external-task/task3/complete") != 0 {
+		t.Fatal(err)
+	}
+
+	err = CompleteCamundaTask(response("task4", "device offline"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failure, ok := engine.Failure("task4"); !ok || failure.ErrorMessage != "device offline" {
+		t.Fatal(failure)
+	}
+
+	if _, ok := CompleteCamundaTask("foo").(InvalidResponseError); !ok {
+		t.Fatal("expected InvalidResponseError")
+	}
+}
+
+func TestCompleteForeignResponse(t *testing.T) {
+	drcloser, deviceRepoUrl, _ := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, _ := PermsearchMock()
+	defer permcloser()
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{
+		CamundaUrl:     camundaUrl,
+		DeviceRepoUrl:  deviceRepoUrl,
+		AuthEndpoint:   authUrl,
+		PermissionsUrl: permUrl,
+	}
+	engine.Lock(testCommandTask("task1", "device1"), "worker2")
+	engine.Lock(testCommandTask("task2", "device1"), "worker2")
+
+	//the echoed service and output name are ignored
+	response := func(workerId string, taskId string) string {
+		msg, _ := json.Marshal(messages.ProtocolMsg{WorkerId: workerId, TaskId: taskId, OutputName: "foo", Service: model.Service{Id: "echoed"}})
+		return string(msg)
+	}
+	dropped := GetInFlightRegistry().Stats().ForeignDropped
+
+	//replicas share the consumer group: foreign responses are verified with camunda by default
+	err := CompleteCamundaTask(response("worker2", "task1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	completion, ok := engine.Completion("task1")
+	if !ok || completion.WorkerId != "worker2" || completion.Variables[CAMUNDA_OUTPUT_NAME].Value.ServiceId != "service1" {
+		t.Fatal(completion)
+	}
+
+	//task2 is not locked by worker3
+	err = CompleteCamundaTask(response("worker3", "task2"))
+	if err != nil || engine.Get("/external-task/task2/complete") != 0 {
+		t.Fatal("response of worker3 accepted", err)
+	}
+	//task3 is unknown
+	err = CompleteCamundaTask(response("worker2", "task3"))
+	if err != nil || engine.Get("/external-task/task3/complete") != 0 {
+		t.Fatal("response for unknown task accepted", err)
+	}
+
+	util.Config.AcceptForeignResponses = "false"
+	err = CompleteCamundaTask(response("worker2", "task2"))
+	if err != nil || engine.Get("/external-task/task2/complete") != 0 {
+		t.Fatal("foreign response accepted although disabled", err)
+	}
+	if count := GetInFlightRegistry().Stats().ForeignDropped - dropped; count != 3 {
+		t.Fatal("dropped foreign responses not counted", count)
+	}
+}
+
+func testCommandTask(id string, deviceId string) messages.CamundaTask {
+	return messages.CamundaTask{
+		Id:          id,
+		TopicName:   "command",
+		ExecutionId: "execution-" + id,
+		TenantId:    "user1",
+		Variables: map[string]messages.CamundaVariable{
+			CAMUNDA_VARIABLES_PAYLOAD: {Value: `{"instance_id": "` + deviceId + `", "service_id": "service1", "inputs": {}}`},
+		},
+	}
+}
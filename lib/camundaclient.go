@@ -0,0 +1,105 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+)
+
+//external task api of the process engine; errors of the engine are returned as CamundaStatusError
+type CamundaClient interface {
+	//fetches and locks tasks; ctx cancels a pending long polling request
+	Fetch(ctx context.Context, request messages.CamundaFetchRequest) (tasks []messages.CamundaTask, err error)
+
+	//camunda does not return variables with a single task
+	Get(taskId string) (task messages.CamundaTask, err error)
+
+	//variable of the task as seen by its execution
+	Variable(task messages.CamundaTask, name string) (variable messages.CamundaVariable, err error)
+
+	//sets a local variable of the execution of the task
+	SetLocalVariable(task messages.CamundaTask, name string, variable messages.CamundaVariable) error
+
+	Complete(taskId string, request messages.CamundaCompleteRequest) error
+
+	Failure(taskId string, failure messages.CamundaError) error
+
+	BpmnError(taskId string, bpmnError messages.CamundaBpmnError) error
+
+	ExtendLock(taskId string, request messages.CamundaExtendLockRequest) error
+
+	//releases the lock so that camunda hands the task out again
+	Unlock(taskId string) error
+
+	SetRetries(taskId string, retries int64) error
+}
+
+//error answer of the engine; camunda describes errors with {"type": "...", "message": "..."}
+type CamundaStatusError struct {
+	Code    int    `json:"-"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+func (this CamundaStatusError) Error() string {
+	return "camunda " + strconv.Itoa(this.Code) + " " + this.Type + ": " + this.Message
+}
+
+//the task does not exist anymore, e.g. because it has been completed or its process instance has been cancelled
+func IsCamundaTaskNotFound(err error) bool {
+	statusErr, ok := err.(CamundaStatusError)
+	return ok && statusErr.Code == http.StatusNotFound
+}
+
+//the task is locked by another worker, e.g. because the lock expired and the task has been fetched again
+func IsCamundaLockLost(err error) bool {
+	statusErr, ok := err.(CamundaStatusError)
+	if !ok || statusErr.Code != http.StatusBadRequest {
+		return false
+	}
+	message := strings.ToLower(statusErr.Message)
+	return strings.Contains(message, "lock") && strings.Contains(message, "worker")
+}
+
+//this worker can not finish the task anymore; results for it have to be dropped
+func IsCamundaTaskGone(err error) bool {
+	return IsCamundaTaskNotFound(err) || IsCamundaLockLost(err)
+}
+
+//camunda is unreachable or answered with a server error; the request may succeed later
+func IsCamundaTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	statusErr, ok := err.(CamundaStatusError)
+	return !ok || statusErr.Code >= 500
+}
+
+var camundaClient CamundaClient = RestCamundaClient{}
+
+func GetCamundaClient() CamundaClient {
+	return camundaClient
+}
+
+func SetCamundaClient(client CamundaClient) {
+	camundaClient = client
+}
@@ -17,19 +17,56 @@
 package lib
 
 import (
+	"context"
 	"log"
 	"time"
 
 	"github.com/SENERGY-Platform/external-task-worker/util"
 )
 
-func CamundaWorker() {
+//fetches and executes tasks until ctx is done; returns after the handlers of the last fetch are finished
+func CamundaWorker(ctx context.Context) {
 	log.Println("start camunda worker")
+	RegisterDeviceCommandTopic()
+	paused := false
 	for {
-		wait := ExecuteNextCamundaTask()
-		if wait {
+		if !CriticalDependenciesUp() {
+			if !paused {
+				log.Println("WARNING: pause camunda worker until all critical dependencies are available")
+				paused = true
+			}
+			select {
+			case <-ctx.Done():
+				log.Println("stop camunda worker")
+				return
+			case <-time.After(time.Duration(util.Config.CamundaWorkerTimeout) * time.Millisecond):
+			}
+			continue
+		}
+		if paused {
+			log.Println("resume camunda worker")
+			paused = false
+		}
+		start := time.Now()
+		wait := ExecuteNextCamundaTask(ctx)
+		if wait && !longPollElapsed(start) {
 			duration := time.Duration(util.Config.CamundaWorkerTimeout) * time.Millisecond
-			time.Sleep(duration)
+			select {
+			case <-ctx.Done():
+			case <-time.After(duration):
+			}
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("stop camunda worker")
+			return
+		default:
 		}
 	}
 }
+
+//true if the last fetch was a long polling request that used its full timeout
+//an engine that ignores asyncResponseTimeout returns immediately and is handled like a normal poll
+func longPollElapsed(start time.Time) bool {
+	return CamundaLongPollEnabled() && time.Since(start) >= time.Duration(util.Config.CamundaLongPollTimeout)*time.Millisecond
+}
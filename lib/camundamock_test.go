@@ -0,0 +1,256 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+)
+
+//fake external task api: hands out queued tasks, checks the locks like camunda and records the results
+type CamundaEngineMock struct {
+	*MockCalls
+	mux         sync.Mutex
+	queue       []messages.CamundaTask
+	locks       map[string]messages.CamundaTask
+	lockOwner   map[string]string
+	completions map[string]messages.CamundaCompleteRequest
+	failures    map[string]messages.CamundaError
+	bpmnErrors  map[string]messages.CamundaBpmnError
+	retries     map[string]int64
+	fetches     []messages.CamundaFetchRequest
+	variables   map[string]map[string]messages.CamundaVariable //local variables by execution
+}
+
+func CamundaMock() (closer func(), url string, engine *CamundaEngineMock) {
+	engine = &CamundaEngineMock{
+		MockCalls:   NewMockCalls(),
+		locks:       map[string]messages.CamundaTask{},
+		lockOwner:   map[string]string{},
+		completions: map[string]messages.CamundaCompleteRequest{},
+		failures:    map[string]messages.CamundaError{},
+		bpmnErrors:  map[string]messages.CamundaBpmnError{},
+		retries:     map[string]int64{},
+		variables:   map[string]map[string]messages.CamundaVariable{},
+	}
+	s := httptest.NewServer(engine.Handler(http.HandlerFunc(engine.serve)))
+	return s.Close, s.URL, engine
+}
+
+//tasks are handed out by the next fetchAndLock requests
+func (this *CamundaEngineMock) Queue(tasks ...messages.CamundaTask) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.queue = append(this.queue, tasks...)
+}
+
+//locks task for workerId as if it had been fetched by that worker
+func (this *CamundaEngineMock) Lock(task messages.CamundaTask, workerId string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.locks[task.Id] = task
+	this.lockOwner[task.Id] = workerId
+}
+
+func (this *CamundaEngineMock) Completion(taskId string) (result messages.CamundaCompleteRequest, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	result, ok = this.completions[taskId]
+	return
+}
+
+func (this *CamundaEngineMock) Failure(taskId string) (result messages.CamundaError, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	result, ok = this.failures[taskId]
+	return
+}
+
+func (this *CamundaEngineMock) BpmnError(taskId string) (result messages.CamundaBpmnError, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	result, ok = this.bpmnErrors[taskId]
+	return
+}
+
+func (this *CamundaEngineMock) Retries(taskId string) (result int64, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	result, ok = this.retries[taskId]
+	return
+}
+
+//fetchAndLock requests received so far
+func (this *CamundaEngineMock) Fetches() []messages.CamundaFetchRequest {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return append([]messages.CamundaFetchRequest{}, this.fetches...)
+}
+
+func (this *CamundaEngineMock) Locked(taskId string) bool {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	_, ok := this.locks[taskId]
+	return ok
+}
+
+func (this *CamundaEngineMock) serve(writer http.ResponseWriter, request *http.Request) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	if strings.HasPrefix(request.URL.Path, "/execution/") {
+		this.serveVariable(writer, request)
+		return
+	}
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/external-task/"), "/")
+	if path[0] == "fetchAndLock" {
+		fetch := messages.CamundaFetchRequest{}
+		json.NewDecoder(request.Body).Decode(&fetch)
+		this.fetches = append(this.fetches, fetch)
+		count := len(this.queue)
+		if fetch.MaxTasks > 0 && int64(count) > fetch.MaxTasks {
+			count = int(fetch.MaxTasks)
+		}
+		tasks := this.queue[:count]
+		this.queue = this.queue[count:]
+		for _, task := range tasks {
+			this.locks[task.Id] = task
+			this.lockOwner[task.Id] = fetch.WorkerId
+		}
+		json.NewEncoder(writer).Encode(tasks)
+		return
+	}
+	taskId := path[0]
+	task, locked := this.locks[taskId]
+	if !locked {
+		camundaMockError(writer, http.StatusNotFound, "External task with id "+taskId+" does not exist")
+		return
+	}
+	action := ""
+	if len(path) > 1 {
+		action = path[1]
+	}
+	worker := struct {
+		WorkerId string `json:"workerId"`
+	}{}
+	switch action {
+	case "":
+		//like camunda: lock owner but no variables
+		task.WorkerId = this.lockOwner[taskId]
+		task.Variables = nil
+		json.NewEncoder(writer).Encode(task)
+		return
+	case "retries":
+		retries := messages.CamundaRetrySetRequest{}
+		json.NewDecoder(request.Body).Decode(&retries)
+		this.retries[taskId] = retries.Retries
+		task.Retries = &retries.Retries
+		this.locks[taskId] = task
+	case "unlock":
+		delete(this.locks, taskId)
+		delete(this.lockOwner, taskId)
+		this.queue = append(this.queue, task)
+	case "complete":
+		completion := messages.CamundaCompleteRequest{}
+		json.NewDecoder(request.Body).Decode(&completion)
+		if !this.checkLock(writer, taskId, completion.WorkerId) {
+			return
+		}
+		this.completions[taskId] = completion
+		delete(this.locks, taskId)
+	case "failure":
+		failure := messages.CamundaError{}
+		json.NewDecoder(request.Body).Decode(&failure)
+		if !this.checkLock(writer, taskId, failure.WorkerId) {
+			return
+		}
+		this.failures[taskId] = failure
+		delete(this.locks, taskId)
+	case "bpmnError":
+		bpmnError := messages.CamundaBpmnError{}
+		json.NewDecoder(request.Body).Decode(&bpmnError)
+		if !this.checkLock(writer, taskId, bpmnError.WorkerId) {
+			return
+		}
+		this.bpmnErrors[taskId] = bpmnError
+		delete(this.locks, taskId)
+	case "extendLock":
+		json.NewDecoder(request.Body).Decode(&worker)
+		if !this.checkLock(writer, taskId, worker.WorkerId) {
+			return
+		}
+	default:
+		camundaMockError(writer, http.StatusNotFound, "unknown action "+action)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+//local variable of an execution; unlike camunda, unknown executions are accepted
+func (this *CamundaEngineMock) LocalVariable(executionId string, name string) (result messages.CamundaVariable, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	result, ok = this.variables[executionId][name]
+	return
+}
+
+//GET and PUT /execution/{id}/localVariables/{name}; variables of locked tasks are local variables of their execution
+func (this *CamundaEngineMock) serveVariable(writer http.ResponseWriter, request *http.Request) {
+	path := strings.Split(strings.TrimPrefix(request.URL.Path, "/execution/"), "/")
+	if len(path) == 3 && path[1] == "localVariables" {
+		if request.Method == "PUT" {
+			variable := messages.CamundaVariable{}
+			json.NewDecoder(request.Body).Decode(&variable)
+			if this.variables[path[0]] == nil {
+				this.variables[path[0]] = map[string]messages.CamundaVariable{}
+			}
+			this.variables[path[0]][path[2]] = variable
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if variable, ok := this.variables[path[0]][path[2]]; ok {
+			json.NewEncoder(writer).Encode(variable)
+			return
+		}
+		for _, task := range this.locks {
+			if variable, ok := task.Variables[path[2]]; ok && task.ExecutionId == path[0] {
+				json.NewEncoder(writer).Encode(variable)
+				return
+			}
+		}
+	}
+	camundaMockError(writer, http.StatusNotFound, "execution variable "+request.URL.Path+" not found")
+}
+
+//camunda answers with 400 if the task is locked by another worker
+func (this *CamundaEngineMock) checkLock(writer http.ResponseWriter, taskId string, workerId string) bool {
+	if owner := this.lockOwner[taskId]; owner != workerId {
+		camundaMockError(writer, http.StatusBadRequest, "External Task "+taskId+" cannot be completed by worker '"+workerId+"'. It is locked by worker '"+owner+"'.")
+		return false
+	}
+	return true
+}
+
+func camundaMockError(writer http.ResponseWriter, code int, message string) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(code)
+	json.NewEncoder(writer).Encode(map[string]string{"type": "RestException", "message": message})
+}
@@ -17,40 +17,147 @@
 package lib
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
 
 	"github.com/satori/go.uuid"
 	"github.com/SENERGY-Platform/external-task-worker/util"
-	"github.com/SmartEnergyPlatform/util/http/request"
 )
 
 var workerId = uuid.NewV4().String()
 
-func GetCamundaTask() (tasks []messages.CamundaTask, err error) {
+func SetWorkerId(id string) {
+	workerId = id
+}
+
+//time added to the long polling timeout before the http client gives up on the fetch request
+const camundaLongPollHttpBuffer = 10 * time.Second
+
+//set to false if the engine rejects asyncResponseTimeout (camunda < 7.8)
+var camundaLongPollSupported = true
+var camundaLongPollMux sync.RWMutex
+
+func CamundaLongPollEnabled() bool {
+	camundaLongPollMux.RLock()
+	defer camundaLongPollMux.RUnlock()
+	return camundaLongPollSupported && util.Config.CamundaLongPollTimeout > 0
+}
+
+func setCamundaLongPollSupported(supported bool) {
+	camundaLongPollMux.Lock()
+	defer camundaLongPollMux.Unlock()
+	camundaLongPollSupported = supported
+}
+
+//older engines fail to deserialize the unknown asyncResponseTimeout field of the fetch request
+func isLongPollUnsupported(err error) bool {
+	statusErr, ok := err.(CamundaStatusError)
+	return ok && statusErr.Code == http.StatusBadRequest && strings.Contains(statusErr.Message, "asyncResponseTimeout")
+}
+
+//ctx cancels a pending long polling request
+func GetCamundaTask(ctx context.Context) (tasks []messages.CamundaTask, err error) {
+	defer func(start time.Time) {
+		FetchDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
 	fetchRequest := messages.CamundaFetchRequest{
 		WorkerId: workerId,
 		MaxTasks: util.Config.CamundaWorkerTasks,
-		Topics:   []messages.CamundaTopic{{LockDuration: util.Config.CamundaFetchLockDuration, Name: util.Config.CamundaTopic}},
+		Topics:   getFetchTopics(),
 	}
-	err, _, _ = request.Post(util.Config.CamundaUrl+"/external-task/fetchAndLock", fetchRequest, &tasks)
-	return
+	if len(fetchRequest.Topics) == 0 {
+		return
+	}
+	if CamundaLongPollEnabled() {
+		fetchRequest.AsyncResponseTimeout = util.Config.CamundaLongPollTimeout
+	}
+	return GetCamundaClient().Fetch(ctx, fetchRequest)
+}
+
+func GetCamundaTaskById(taskId string) (task messages.CamundaTask, err error) {
+	return GetCamundaClient().Get(taskId)
+}
+
+func SetCamundaRetry(taskid string, retries int64) error {
+	return GetCamundaClient().SetRetries(taskid, retries)
+}
+
+//QosStrategy "<=": the marker is stored in camunda, so that it holds for every worker and across restarts
+//its value is the id of the task; a marker of an earlier task of the same execution (e.g. in a loop) is ignored
+func MarkCommandSent(task messages.CamundaTask) error {
+	return GetCamundaClient().SetLocalVariable(task, CAMUNDA_VARIABLES_COMMAND_SENT, messages.CamundaVariable{Type: "String", Value: task.Id})
+}
+
+//resets the marker if the command could not be sent
+func UnmarkCommandSent(task messages.CamundaTask) error {
+	return GetCamundaClient().SetLocalVariable(task, CAMUNDA_VARIABLES_COMMAND_SENT, messages.CamundaVariable{Type: "String", Value: ""})
+}
+
+func IsCommandSent(task messages.CamundaTask) (bool, error) {
+	variable, err := GetCamundaClient().Variable(task, CAMUNDA_VARIABLES_COMMAND_SENT)
+	if IsCamundaTaskNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return variable.Value == task.Id, nil
+}
+
+//reports a failure without retries; camunda raises an incident
+func CamundaError(task messages.CamundaTask, msg string) error {
+	return camundaFailure(task, msg, 0, 0)
+}
+
+//reports a failure with retries and retryTimeout as defined by the retry policy of the error class
+func CamundaRetryableError(task messages.CamundaTask, class string, msg string) {
+	retries, retryTimeout := GetRetryPolicy(class, task.Retries)
+	camundaFailure(task, msg, retries, retryTimeout)
+}
+
+func camundaFailure(task messages.CamundaTask, msg string, retries int64, retryTimeout int64) error {
+	errorMsg := messages.CamundaError{WorkerId: GetWorkerId(), ErrorMessage: msg, Retries: retries, RetryTimeout: retryTimeout, ErrorDetails: msg}
+	log.Println("Send Error to Camunda: ", msg, retries, retryTimeout)
+	err := GetCamundaClient().Failure(task.Id, errorMsg)
+	logCamundaResult("failure", task.Id, err)
+	return err
+}
+
+func CamundaBpmnError(task messages.CamundaTask, errorCode string, msg string, variables map[string]messages.CamundaOutput) {
+	bpmnError := messages.CamundaBpmnError{WorkerId: GetWorkerId(), ErrorCode: errorCode, ErrorMessage: msg, Variables: variables}
+	log.Println("Send BPMN-Error to Camunda: ", errorCode, msg)
+	logCamundaResult("bpmn error", task.Id, GetCamundaClient().BpmnError(task.Id, bpmnError))
 }
 
-func SetCamundaRetry(taskid string) {
-	retry := messages.CamundaRetrySetRequest{Retries: 1}
-	request.Put(util.Config.CamundaUrl+"/external-task/"+taskid+"/retries", retry, nil)
+func logCamundaResult(action string, taskId string, err error) {
+	if IsCamundaTaskGone(err) {
+		log.Println("WARNING: camunda task is gone; drop", action, taskId, err)
+	} else if err != nil {
+		log.Println("ERROR: unable to send", action, "to camunda", taskId, err)
+	}
+}
+
+func ExtendCamundaLock(taskId string, duration int64) (err error) {
+	return GetCamundaClient().ExtendLock(taskId, messages.CamundaExtendLockRequest{WorkerId: GetWorkerId(), NewDuration: duration})
 }
 
-func CamundaError(task messages.CamundaTask, msg string) {
-	errorMsg := messages.CamundaError{WorkerId: GetWorkerId(), ErrorMessage: msg, Retries: 0, ErrorDetails: msg}
-	log.Println("Send Error to Camunda: ", msg)
-	log.Println(request.Post(util.Config.CamundaUrl+"/external-task/"+task.Id+"/failure", errorMsg, nil))
-	//this.completeCamundaTask(taskid, this.GetWorkerId(), "error", messages.BpmnMsg{ErrorMsg:msg})
+//releases the lock so that camunda hands the task out again
+func UnlockCamundaTask(taskId string) (err error) {
+	return GetCamundaClient().Unlock(taskId)
 }
 
-func completeCamundaTask(taskId string, workerId string, outputName string, output messages.BpmnMsg) (err error) {
+func completeCamundaTask(task messages.CamundaTask, workerId string, outputName string, output messages.BpmnMsg) (err error) {
 	if workerId == "" {
 		workerId = GetWorkerId()
 	}
@@ -61,17 +168,163 @@ func completeCamundaTask(taskId string, workerId string, outputName string, outp
 		},
 	}
 	completeRequest := messages.CamundaCompleteRequest{WorkerId: workerId, Variables: variables}
-	pl := ""
-	var code int
-	err, pl, code = request.Post(util.Config.CamundaUrl+"/external-task/"+taskId+"/complete", completeRequest, nil)
-	if code == 204 || code == 200 {
-		log.Println("complete camunda task: ", completeRequest, pl)
-	}else{
-		CamundaError(messages.CamundaTask{Id:taskId}, pl)
+	err = GetCamundaClient().Complete(task.Id, completeRequest)
+	if IsCamundaTaskGone(err) {
+		//the task has been completed, cancelled or handed out again; the result is obsolete
+		log.Println("WARNING: drop response; camunda task is gone", task.Id, err)
+		return nil
 	}
-	return
+	if IsCamundaTransient(err) {
+		//camunda unreachable or still failing after all retries: the caller keeps the response to complete it later
+		return err
+	}
+	if statusErr, ok := err.(CamundaStatusError); ok {
+		//camunda rejected the result: the task fails instead; the response is done once the failure is known to camunda
+		countTaskFailure(task.TopicName, ErrorClassInternal)
+		if err := CamundaError(task, statusErr.Message); IsCamundaTransient(err) {
+			return err
+		}
+		return nil
+	}
+	log.Println("complete camunda task: ", completeRequest)
+	TasksCompleted.WithLabelValues(task.TopicName).Inc()
+	return nil
+}
+
+func NewCamundaCompleteBackoff() *Backoff {
+	initial := time.Duration(util.Config.CamundaCompleteRetryBackoff) * time.Millisecond
+	if initial <= 0 {
+		initial = time.Second
+	}
+	return &Backoff{Initial: initial, Max: time.Minute}
 }
 
 func GetWorkerId() string {
 	return workerId
 }
+
+//default CamundaClient; uses the rest api of util.Config.CamundaUrl
+//transient errors of results (complete, failure, bpmn error) are retried CamundaCompleteRetries times;
+//other requests are sent once, their callers repeat them anyway (worker loop, lock supervisor) or must not be delayed (shutdown)
+type RestCamundaClient struct{}
+
+func (this RestCamundaClient) taskUrl(taskId string, action string) string {
+	return util.Config.CamundaUrl + "/external-task/" + url.PathEscape(taskId) + action
+}
+
+func (this RestCamundaClient) Fetch(ctx context.Context, fetchRequest messages.CamundaFetchRequest) (tasks []messages.CamundaTask, err error) {
+	client := http.DefaultClient
+	if fetchRequest.AsyncResponseTimeout > 0 {
+		client = &http.Client{
+			Timeout: time.Duration(fetchRequest.AsyncResponseTimeout)*time.Millisecond + camundaLongPollHttpBuffer,
+		}
+	}
+	err = this.request(ctx, client, "POST", util.Config.CamundaUrl+"/external-task/fetchAndLock", fetchRequest, &tasks)
+	if fetchRequest.AsyncResponseTimeout > 0 && isLongPollUnsupported(err) {
+		log.Println("WARNING: camunda does not support long polling; fall back to polling", err)
+		setCamundaLongPollSupported(false)
+		return nil, nil
+	}
+	return
+}
+
+func (this RestCamundaClient) Get(taskId string) (task messages.CamundaTask, err error) {
+	err = this.do("GET", this.taskUrl(taskId, ""), nil, &task)
+	return
+}
+
+//local variables of the execution (e.g. input mappings of the service task) before variables of the process instance
+func (this RestCamundaClient) Variable(task messages.CamundaTask, name string) (variable messages.CamundaVariable, err error) {
+	err = this.do("GET", util.Config.CamundaUrl+"/execution/"+url.PathEscape(task.ExecutionId)+"/localVariables/"+url.PathEscape(name), nil, &variable)
+	if IsCamundaTaskNotFound(err) {
+		err = this.do("GET", util.Config.CamundaUrl+"/process-instance/"+url.PathEscape(task.ProcessInstanceId)+"/variables/"+url.PathEscape(name), nil, &variable)
+	}
+	return
+}
+
+func (this RestCamundaClient) SetLocalVariable(task messages.CamundaTask, name string, variable messages.CamundaVariable) error {
+	return this.do("PUT", util.Config.CamundaUrl+"/execution/"+url.PathEscape(task.ExecutionId)+"/localVariables/"+url.PathEscape(name), variable, nil)
+}
+
+func (this RestCamundaClient) Complete(taskId string, completeRequest messages.CamundaCompleteRequest) error {
+	return this.doWithRetries("POST", this.taskUrl(taskId, "/complete"), completeRequest, nil)
+}
+
+func (this RestCamundaClient) Failure(taskId string, failure messages.CamundaError) error {
+	return this.doWithRetries("POST", this.taskUrl(taskId, "/failure"), failure, nil)
+}
+
+func (this RestCamundaClient) BpmnError(taskId string, bpmnError messages.CamundaBpmnError) error {
+	return this.doWithRetries("POST", this.taskUrl(taskId, "/bpmnError"), bpmnError, nil)
+}
+
+func (this RestCamundaClient) ExtendLock(taskId string, extendRequest messages.CamundaExtendLockRequest) error {
+	return this.do("POST", this.taskUrl(taskId, "/extendLock"), extendRequest, nil)
+}
+
+func (this RestCamundaClient) Unlock(taskId string) error {
+	return this.do("POST", this.taskUrl(taskId, "/unlock"), nil, nil)
+}
+
+func (this RestCamundaClient) SetRetries(taskId string, retries int64) error {
+	return this.do("PUT", this.taskUrl(taskId, "/retries"), messages.CamundaRetrySetRequest{Retries: retries}, nil)
+}
+
+func (this RestCamundaClient) do(method string, url string, body interface{}, result interface{}) (err error) {
+	return this.request(context.Background(), http.DefaultClient, method, url, body, result)
+}
+
+//retries transient errors with NewCamundaCompleteBackoff()
+func (this RestCamundaClient) doWithRetries(method string, url string, body interface{}, result interface{}) (err error) {
+	backoff := NewCamundaCompleteBackoff()
+	for retry := int64(0); ; retry++ {
+		err = this.do(method, url, body, result)
+		if !IsCamundaTransient(err) || retry >= util.Config.CamundaCompleteRetries {
+			return err
+		}
+		wait := backoff.Next()
+		log.Println("WARNING: camunda request failed; retry in", wait, method, url, err)
+		time.Sleep(wait)
+	}
+}
+
+//answers with status >= 300 are returned as CamundaStatusError
+func (this RestCamundaClient) request(ctx context.Context, client *http.Client, method string, url string, body interface{}, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		b := new(bytes.Buffer)
+		err := json.NewEncoder(b).Encode(body)
+		if err != nil {
+			return err
+		}
+		payload = b
+	}
+	req, err := http.NewRequest(method, url, payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return decodeCamundaError(resp)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+func decodeCamundaError(resp *http.Response) error {
+	result := CamundaStatusError{Code: resp.StatusCode}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(body, &result) != nil || result.Message == "" {
+		result.Message = string(body)
+	}
+	return result
+}
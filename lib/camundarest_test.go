@@ -0,0 +1,174 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestRestCamundaClientErrors(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl, CamundaCompleteRetries: 2, CamundaCompleteRetryBackoff: 1}
+	client := RestCamundaClient{}
+
+	err := client.Complete("unknown", messages.CamundaCompleteRequest{WorkerId: "worker1"})
+	if statusErr, ok := err.(CamundaStatusError); !ok || statusErr.Type != "RestException" || statusErr.Message == "" {
+		t.Fatal(err)
+	}
+	if !IsCamundaTaskNotFound(err) || !IsCamundaTaskGone(err) || IsCamundaLockLost(err) || IsCamundaTransient(err) {
+		t.Fatal("unexpected classification", err)
+	}
+	if engine.Get("/external-task/unknown/complete") != 1 {
+		t.Fatal("client errors must not be retried")
+	}
+
+	engine.Lock(messages.CamundaTask{Id: "task1"}, "worker2")
+	err = client.ExtendLock("task1", messages.CamundaExtendLockRequest{WorkerId: "worker1", NewDuration: 1000})
+	if !IsCamundaLockLost(err) || !IsCamundaTaskGone(err) || IsCamundaTaskNotFound(err) {
+		t.Fatal("unexpected classification", err)
+	}
+	task, err := client.Get("task1")
+	if err != nil || task.Id != "task1" {
+		t.Fatal(task, err)
+	}
+
+	//server errors of results are retried
+	calls := 0
+	unstable := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		if calls < 3 {
+			camundaMockError(writer, http.StatusServiceUnavailable, "busy")
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer unstable.Close()
+	util.Config.CamundaUrl = unstable.URL
+	err = client.Complete("task1", messages.CamundaCompleteRequest{WorkerId: "worker1"})
+	if err != nil || calls != 3 {
+		t.Fatal(err, calls)
+	}
+	calls = 0
+	util.Config.CamundaCompleteRetries = 1
+	err = client.Failure("task1", messages.CamundaError{WorkerId: "worker1"})
+	if !IsCamundaTransient(err) || IsCamundaTaskGone(err) || calls != 2 {
+		t.Fatal(err, calls)
+	}
+
+	//lock handling is not delayed by retries; the supervisor and the worker loop repeat these requests anyway
+	for _, request := range []func() error{
+		func() error { return client.Unlock("task1") },
+		func() error { return client.ExtendLock("task1", messages.CamundaExtendLockRequest{WorkerId: "worker1"}) },
+		func() error { return client.SetRetries("task1", 1) },
+	} {
+		calls = 0
+		if err := request(); !IsCamundaTransient(err) || calls != 1 {
+			t.Fatal(err, calls)
+		}
+	}
+
+	//unreachable camunda
+	unstable.Close()
+	start := time.Now()
+	err = client.Failure("task1", messages.CamundaError{WorkerId: "worker1"})
+	if err == nil || !IsCamundaTransient(err) {
+		t.Fatal(err)
+	}
+	if _, ok := err.(CamundaStatusError); ok || time.Since(start) > time.Second {
+		t.Fatal(err, time.Since(start))
+	}
+}
+
+func TestCompleteCamundaTaskServerError(t *testing.T) {
+	calls := NewMockCalls()
+	camunda := httptest.NewServer(calls.Handler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/external-task/task2/complete":
+			camundaMockError(writer, http.StatusBadRequest, "invalid variable value")
+		case "/external-task/task2/failure":
+			camundaMockError(writer, http.StatusServiceUnavailable, "busy")
+		default:
+			camundaMockError(writer, http.StatusInternalServerError, "database unavailable")
+		}
+	})))
+	defer camunda.Close()
+	util.Config = &util.ConfigStruct{CamundaUrl: camunda.URL, CamundaCompleteRetries: 2, CamundaCompleteRetryBackoff: 1}
+
+	//the server error persists through every retry: the result is kept for a later completion
+	err := completeCamundaTask(messages.CamundaTask{Id: "task1"}, "worker1", CAMUNDA_OUTPUT_NAME, messages.BpmnMsg{})
+	if !IsCamundaTransient(err) {
+		t.Fatal(err)
+	}
+	if calls.Get("/external-task/task1/complete") != 3 || calls.Get("/external-task/task1/failure") != 0 {
+		t.Fatal("unexpected camunda calls")
+	}
+
+	//rejected result whose failure report fails as well
+	err = completeCamundaTask(messages.CamundaTask{Id: "task2"}, "worker1", CAMUNDA_OUTPUT_NAME, messages.BpmnMsg{})
+	if !IsCamundaTransient(err) {
+		t.Fatal(err)
+	}
+	if calls.Get("/external-task/task2/complete") != 1 || calls.Get("/external-task/task2/failure") != 3 {
+		t.Fatal("unexpected camunda calls")
+	}
+}
+
+func TestFetchLongPollFallback(t *testing.T) {
+	defer setCamundaLongPollSupported(true)
+	var asyncResponseTimeouts []int64
+	camunda := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		fetchRequest := messages.CamundaFetchRequest{}
+		json.NewDecoder(request.Body).Decode(&fetchRequest)
+		asyncResponseTimeouts = append(asyncResponseTimeouts, fetchRequest.AsyncResponseTimeout)
+		switch {
+		case len(fetchRequest.Topics) == 0:
+			camundaMockError(writer, http.StatusBadRequest, "topics must not be empty")
+		case fetchRequest.AsyncResponseTimeout > 0:
+			camundaMockError(writer, http.StatusBadRequest, "Unrecognized field \"asyncResponseTimeout\" (class org.camunda.bpm.engine.rest.dto.externaltask.FetchExternalTasksDto)")
+		default:
+			json.NewEncoder(writer).Encode([]messages.CamundaTask{})
+		}
+	}))
+	defer camunda.Close()
+	util.Config = &util.ConfigStruct{CamundaUrl: camunda.URL, CamundaLongPollTimeout: 1000}
+	client := RestCamundaClient{}
+
+	//other bad requests keep long polling enabled
+	_, err := client.Fetch(context.Background(), messages.CamundaFetchRequest{AsyncResponseTimeout: 1000})
+	if err == nil || !CamundaLongPollEnabled() {
+		t.Fatal("unexpected fallback to polling", err)
+	}
+
+	topics := []messages.CamundaTopic{{Name: "topic1"}}
+	tasks, err := client.Fetch(context.Background(), messages.CamundaFetchRequest{AsyncResponseTimeout: 1000, Topics: topics})
+	if err != nil || len(tasks) != 0 || CamundaLongPollEnabled() {
+		t.Fatal("missing fallback to polling", tasks, err)
+	}
+	_, err = client.Fetch(context.Background(), messages.CamundaFetchRequest{Topics: topics})
+	if err != nil || len(asyncResponseTimeouts) != 3 || asyncResponseTimeouts[2] != 0 {
+		t.Fatal(err, asyncResponseTimeouts)
+	}
+}
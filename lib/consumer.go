@@ -17,24 +17,85 @@
 package lib
 
 import (
+	"context"
+	"errors"
 	"log"
 
 	"github.com/SENERGY-Platform/external-task-worker/util"
 
 	"time"
 
+	"github.com/Shopify/sarama"
 	"github.com/wvanbergen/kafka/consumergroup"
 	kazoo "github.com/wvanbergen/kazoo-go"
 )
 
-func InitConsumer() {
-	defer CloseProducer()
-	Produce(util.Config.ResponseTopic, "topic_init")
+//a response could not be completed (e.g. camunda is unreachable); the zookeeper consumer reconnects to consume it again, the consumer group retries it in place
+type ResponseNotDoneError struct {
+	Err error
+}
+
+func (this ResponseNotDoneError) Error() string {
+	return "response not done: " + this.Err.Error()
+}
 
+//consumes responses until ctx is done; kafka problems are handled according to GetKafkaErrorPolicy()
+func InitConsumer(ctx context.Context, handler ResponseHandler) {
+	backoff := NewKafkaReconnectBackoff()
+	for {
+		start := time.Now()
+		err := consumeResponses(ctx, handler)
+		if err == nil {
+			return
+		}
+		if _, ok := err.(ResponseNotDoneError); ok {
+			log.Println("WARNING: response not done; consume again", err)
+		} else {
+			log.Println("ERROR: kafka consumer", err)
+			ReportHealth(HealthKafkaConsumer, true, err)
+			if GetKafkaErrorPolicy() == KafkaErrorsFatal {
+				log.Fatal("kafka consumer error: ", err)
+			}
+		}
+		if time.Since(start) > backoff.Max {
+			backoff.Reset()
+		}
+		wait := backoff.Next()
+		log.Println("reconnect kafka consumer in", wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+//returns nil if ctx is done; an error if the consumer should reconnect
+func consumeResponses(ctx context.Context, handler ResponseHandler) (err error) {
+	err = Produce(util.Config.ResponseTopic, "topic_init")
+	if err != nil {
+		return err
+	}
+	if util.Config.KafkaBootstrap == "" {
+		return consumeResponsesZookeeper(ctx, handler)
+	}
+	return consumeResponsesGroup(ctx, handler)
+}
+
+//legacy consumer: zookeeper based consumer group with offsets stored in zookeeper
+func consumeResponsesZookeeper(ctx context.Context, handler ResponseHandler) (err error) {
 	zk, chroot := kazoo.ParseConnectionString(util.Config.ZookeeperUrl)
 	kafkaconf := consumergroup.NewConfig()
-	kafkaconf.Consumer.Return.Errors = util.Config.FatalKafkaErrors == "true"
+	kafkaconf.Consumer.Return.Errors = GetKafkaErrorPolicy() != KafkaErrorsIgnore
 	kafkaconf.Zookeeper.Chroot = chroot
+	kafkaconf.Version, err = getKafkaVersion(kafkaconf.Version)
+	if err != nil {
+		return err
+	}
+	err = SetKafkaSecurity(kafkaconf.Config)
+	if err != nil {
+		return err
+	}
 	consumerGroupName := util.Config.KafkaConsumerGroup
 	consumer, err := consumergroup.JoinConsumerGroup(
 		consumerGroupName,
@@ -43,50 +104,212 @@ func InitConsumer() {
 		kafkaconf)
 
 	if err != nil {
-		log.Fatal("error in consumergroup.JoinConsumerGroup()", err)
+		log.Println("error in consumergroup.JoinConsumerGroup()", err)
+		return err
 	}
 
 	defer consumer.Close()
+	ReportHealth(HealthKafkaConsumer, true, nil)
 
-	kafkaTimeout := util.Config.KafkaTimeout
-	useTimeout := true
-	if kafkaTimeout <= 0 {
-		useTimeout = false
-		kafkaTimeout = 3600
-	}
-	kafkaping := time.NewTicker(time.Second * time.Duration(kafkaTimeout/2))
-	kafkatimout := time.NewTicker(time.Second * time.Duration(kafkaTimeout))
-
-	timeout := false
+	heartbeat := newConsumerHeartbeat()
+	defer heartbeat.Stop()
 
 	for {
 		select {
-		case <-kafkaping.C:
-			if useTimeout && timeout {
-				Produce(util.Config.ResponseTopic, "topic_init")
+		case <-ctx.Done():
+			log.Println("stop kafka consumer")
+			ReportHealth(HealthKafkaConsumer, true, errors.New("consumer stopped"))
+			return nil
+		case <-heartbeat.ping.C:
+			heartbeat.Ping()
+		case <-heartbeat.timeout.C:
+			if err = heartbeat.Timeout(); err != nil {
+				return err
 			}
-		case <-kafkatimout.C:
-			if useTimeout && timeout {
-				log.Fatal("ERROR: kafka missing ping timeout")
-			}
-			timeout = true
 		case errMsg := <-consumer.Errors():
-			log.Fatal("kafka consumer error: ", errMsg)
+			if GetKafkaErrorPolicy() != KafkaErrorsIgnore {
+				return errMsg
+			}
+			log.Println("WARNING: ignore kafka consumer error", errMsg)
 		case msg, ok := <-consumer.Messages():
 			if !ok {
-				log.Fatal("empty kafka consumer")
+				return errors.New("empty kafka consumer")
 			} else {
-				if string(msg.Value) != "topic_init" {
-					err = CompleteCamundaTask(string(msg.Value))
-					if err != nil {
-						log.Println("error while processing kafka message", err, string(msg.Value))
-					} else {
-						consumer.CommitUpto(msg)
-					}
+				err = consumeResponse(handler, msg)
+				if err != nil {
+					//reconnect; the uncommitted message is consumed again
+					return err
 				}
-				timeout = false
+				heartbeat.Received()
 				consumer.CommitUpto(msg)
 			}
 		}
 	}
 }
+
+//consumer group of the kafka brokers (KafkaBootstrap); offsets are committed to the brokers
+func consumeResponsesGroup(ctx context.Context, handler ResponseHandler) (err error) {
+	broker, err := GetBrokerList()
+	if err != nil {
+		return err
+	}
+	kafkaconf, err := NewKafkaConsumerConfig(sarama.V0_10_2_0) //min version for consumer groups
+	if err != nil {
+		return err
+	}
+	kafkaconf.Consumer.Return.Errors = GetKafkaErrorPolicy() != KafkaErrorsIgnore
+	kafkaconf.Consumer.Offsets.Initial = sarama.OffsetNewest
+	group, err := sarama.NewConsumerGroup(broker, util.Config.KafkaConsumerGroup, kafkaconf)
+	if err != nil {
+		log.Println("error in sarama.NewConsumerGroup()", broker, err)
+		return err
+	}
+	defer group.Close()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	groupHandler := &responseGroupHandler{handler: handler, received: make(chan bool, 1)}
+	consumeErr := make(chan error, 1)
+	go func() {
+		//Consume returns on every rebalance and has to be called again
+		for {
+			err := group.Consume(sessionCtx, []string{util.Config.ResponseTopic}, groupHandler)
+			if err != nil {
+				consumeErr <- err
+				return
+			}
+			if sessionCtx.Err() != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := newConsumerHeartbeat()
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("stop kafka consumer")
+			ReportHealth(HealthKafkaConsumer, true, errors.New("consumer stopped"))
+			return nil
+		case err = <-consumeErr:
+			return err
+		case <-heartbeat.ping.C:
+			heartbeat.Ping()
+		case <-heartbeat.timeout.C:
+			if err = heartbeat.Timeout(); err != nil {
+				return err
+			}
+		case errMsg := <-group.Errors():
+			if GetKafkaErrorPolicy() != KafkaErrorsIgnore {
+				return errMsg
+			}
+			log.Println("WARNING: ignore kafka consumer error", errMsg)
+		case <-groupHandler.received:
+			heartbeat.Received()
+		}
+	}
+}
+
+type responseGroupHandler struct {
+	handler  ResponseHandler
+	received chan bool
+}
+
+func (this *responseGroupHandler) Setup(sarama.ConsumerGroupSession) error {
+	ReportHealth(HealthKafkaConsumer, true, nil)
+	return nil
+}
+
+func (this *responseGroupHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+//a response that is not done is retried in place like in the other transports; leaving the group would rebalance every worker
+//later messages of the partition must not be marked before it, so the claim waits until the response is done or the session ends
+func (this *responseGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		backoff := NewKafkaReconnectBackoff()
+		for err := consumeResponse(this.handler, msg); err != nil; err = consumeResponse(this.handler, msg) {
+			wait := backoff.Next()
+			log.Println("WARNING: response not done; retry in", wait, err)
+			select {
+			case <-session.Context().Done():
+				//the unmarked message is consumed again by the next session
+				return nil
+			case <-time.After(wait):
+			}
+		}
+		session.MarkMessage(msg, "")
+		select {
+		case this.received <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+//pings are skipped; a ResponseNotDoneError means that msg has to be consumed again
+func consumeResponse(handler ResponseHandler, msg *sarama.ConsumerMessage) error {
+	if string(msg.Value) == "topic_init" {
+		return nil
+	}
+	err := handler(Response{Value: string(msg.Value), Topic: msg.Topic, Partition: msg.Partition, Offset: msg.Offset})
+	if err != nil {
+		return ResponseNotDoneError{Err: err}
+	}
+	return nil
+}
+
+//detects a silent consumer by producing "topic_init" pings if no message arrived for KafkaTimeout/2
+type consumerHeartbeat struct {
+	useTimeout bool
+	missing    bool
+	ping       *time.Ticker
+	timeout    *time.Ticker
+}
+
+func newConsumerHeartbeat() *consumerHeartbeat {
+	kafkaTimeout := util.Config.KafkaTimeout
+	useTimeout := true
+	if kafkaTimeout <= 0 {
+		useTimeout = false
+		kafkaTimeout = 3600
+	}
+	return &consumerHeartbeat{
+		useTimeout: useTimeout,
+		ping:       time.NewTicker(time.Second * time.Duration(kafkaTimeout/2)),
+		timeout:    time.NewTicker(time.Second * time.Duration(kafkaTimeout)),
+	}
+}
+
+func (this *consumerHeartbeat) Ping() {
+	if this.useTimeout && this.missing {
+		Produce(util.Config.ResponseTopic, "topic_init")
+	}
+}
+
+func (this *consumerHeartbeat) Timeout() error {
+	if this.useTimeout && this.missing {
+		if GetKafkaErrorPolicy() != KafkaErrorsIgnore {
+			return errors.New("kafka missing ping timeout")
+		}
+		log.Println("WARNING: kafka missing ping timeout")
+		ReportHealth(HealthKafkaConsumer, true, errors.New("kafka missing ping timeout"))
+	}
+	this.missing = true
+	return nil
+}
+
+func (this *consumerHeartbeat) Received() {
+	if this.missing {
+		ReportHealth(HealthKafkaConsumer, true, nil)
+	}
+	this.missing = false
+}
+
+func (this *consumerHeartbeat) Stop() {
+	this.ping.Stop()
+	this.timeout.Stop()
+}
@@ -0,0 +1,187 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+//in-memory stand-in for the session of a consumer group; records marked offsets
+type sessionStandIn struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	marked []int64
+}
+
+func (this *sessionStandIn) Context() context.Context {
+	return this.ctx
+}
+
+func (this *sessionStandIn) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	this.marked = append(this.marked, msg.Offset)
+}
+
+type claimStandIn struct {
+	sarama.ConsumerGroupClaim
+	messages chan *sarama.ConsumerMessage
+}
+
+func (this *claimStandIn) Messages() <-chan *sarama.ConsumerMessage {
+	return this.messages
+}
+
+func newClaimStandIn(values map[int64]string) *claimStandIn {
+	claim := &claimStandIn{messages: make(chan *sarama.ConsumerMessage, len(values))}
+	for offset := int64(0); len(claim.messages) < len(values); offset++ {
+		if value, ok := values[offset]; ok {
+			claim.messages <- &sarama.ConsumerMessage{Topic: "response", Offset: offset, Value: []byte(value)}
+		}
+	}
+	close(claim.messages)
+	return claim
+}
+
+func TestConsumerCommitsDoneResponses(t *testing.T) {
+	mux := sync.Mutex{}
+	mode := "down"
+	calls := map[string]int{}
+	camunda := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		calls[request.URL.Path]++
+		switch mode {
+		case "down":
+			panic(http.ErrAbortHandler)
+		case "error":
+			if request.URL.Path == "/external-task/task3/complete" {
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		case "rejected":
+			if request.URL.Path == "/external-task/task3/complete" {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer camunda.Close()
+	setMode := func(m string) {
+		mux.Lock()
+		defer mux.Unlock()
+		mode = m
+	}
+	getCalls := func(path string) int {
+		mux.Lock()
+		defer mux.Unlock()
+		return calls[path]
+	}
+
+	util.Config = &util.ConfigStruct{CamundaUrl: camunda.URL, CamundaCompleteRetries: 2, CamundaCompleteRetryBackoff: 1, KafkaReconnectBackoff: 10, KafkaReconnectMaxBackoff: 10}
+	response := func(taskId string) string {
+		msg, _ := json.Marshal(messages.ProtocolMsg{WorkerId: GetWorkerId(), TaskId: taskId, OutputName: "result"})
+		return string(msg)
+	}
+	registry := GetInFlightRegistry()
+	for _, id := range []string{"task1", "task2", "task3"} {
+		registry.Add(InFlightTask{Task: messages.CamundaTask{Id: id}, WorkerId: GetWorkerId(), OutputName: "result", Deadline: time.Now().Add(time.Minute)})
+	}
+
+	handler := &responseGroupHandler{handler: HandleResponse, received: make(chan bool, 1)}
+	consume := func(values map[int64]string) (session *sessionStandIn, cancel func(), done chan error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		session = &sessionStandIn{ctx: ctx}
+		done = make(chan error, 1)
+		go func() {
+			done <- handler.ConsumeClaim(session, newClaimStandIn(values))
+		}()
+		return session, cancel, done
+	}
+	waitForCalls := func(path string, count int) {
+		for i := 0; getCalls(path) < count; i++ {
+			if i > 100 {
+				t.Fatal("missing calls", path, getCalls(path))
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	//camunda unreachable: the response is retried in place and marked once it is done; later responses wait for it
+	session, cancel, done := consume(map[int64]string{0: "topic_init", 1: response("task1"), 2: response("task2")})
+	waitForCalls("/external-task/task1/complete", 6)
+	if getCalls("/external-task/task2/complete") != 0 {
+		t.Fatal(calls)
+	}
+	setMode("ok")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if !reflect.DeepEqual(session.marked, []int64{0, 1, 2}) {
+		t.Fatal(session.marked)
+	}
+	if _, ok := registry.Get("task1"); ok {
+		t.Fatal("task1 still in flight")
+	}
+
+	//server error through all retries: not done, no failure is reported; the message stays unmarked when the session ends
+	setMode("error")
+	session, cancel, done = consume(map[int64]string{3: response("task3"), 4: "not json"})
+	waitForCalls("/external-task/task3/complete", 3)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(session.marked) != 0 {
+		t.Fatal(session.marked)
+	}
+	if getCalls("/external-task/task3/failure") != 0 {
+		t.Fatal(calls)
+	}
+	if _, ok := registry.Get("task3"); !ok {
+		t.Fatal("task3 not restored")
+	}
+
+	//rejected completion and invalid response are done after the failure has been reported or the response dropped
+	setMode("rejected")
+	completions := getCalls("/external-task/task3/complete")
+	session, cancel, done = consume(map[int64]string{3: response("task3"), 4: "not json"})
+	defer cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(session.marked, []int64{3, 4}) {
+		t.Fatal(session.marked)
+	}
+	if getCalls("/external-task/task3/complete") != completions+1 || getCalls("/external-task/task3/failure") != 1 {
+		t.Fatal(calls)
+	}
+	if registry.Len() != 0 {
+		t.Fatal(registry.List())
+	}
+}
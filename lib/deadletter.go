@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+//publishes a response that failed with InvalidResponseError to DeadLetterTopic
+func PublishDeadLetter(response Response, cause error) error {
+	if util.Config.DeadLetterTopic == "" {
+		return errors.New("no DeadLetterTopic configured")
+	}
+	deadLetter, err := json.Marshal(messages.DeadLetter{
+		Response:  response.Value,
+		Error:     cause.Error(),
+		Topic:     response.Topic,
+		Partition: response.Partition,
+		Offset:    response.Offset,
+		Time:      time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = GetTransport().Publish("", CommandMessage{Topic: util.Config.DeadLetterTopic, Value: string(deadLetter)})
+	if err != nil {
+		return err
+	}
+	DeadLetters.Inc()
+	return nil
+}
+
+//a replay ends if no dead letter arrives within this duration, e.g. because the last offsets are no messages (compaction, transaction markers)
+var deadLetterReplayTimeout = 10 * time.Second
+
+//replays all dead letters from offset (or sarama.OffsetOldest) up to the newest message at the start of the replay
+func ReplayDeadLetters(offset int64) (replayed int, failed int, err error) {
+	if util.Config.DeadLetterTopic == "" {
+		return replayed, failed, errors.New("no DeadLetterTopic configured")
+	}
+	broker, err := GetBrokerList()
+	if err != nil {
+		return replayed, failed, err
+	}
+	config, err := NewKafkaConsumerConfig(sarama.V0_10_0_1)
+	if err != nil {
+		return replayed, failed, err
+	}
+	client, err := sarama.NewClient(broker, config)
+	if err != nil {
+		return replayed, failed, err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return replayed, failed, err
+	}
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(util.Config.DeadLetterTopic)
+	if err != nil {
+		return replayed, failed, err
+	}
+	for _, partition := range partitions {
+		newest, err := client.GetOffset(util.Config.DeadLetterTopic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return replayed, failed, err
+		}
+		oldest, err := client.GetOffset(util.Config.DeadLetterTopic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return replayed, failed, err
+		}
+		start := offset
+		if start < oldest {
+			start = oldest
+		}
+		if start >= newest {
+			continue
+		}
+		partitionConsumer, err := consumer.ConsumePartition(util.Config.DeadLetterTopic, partition, start)
+		if err != nil {
+			return replayed, failed, err
+		}
+		replayedPartition, failedPartition := replayDeadLetterPartition(partitionConsumer, newest)
+		replayed += replayedPartition
+		failed += failedPartition
+		partitionConsumer.Close()
+	}
+	return replayed, failed, nil
+}
+
+//consumes until newest (the high water mark at the start of the replay) is reached or no message arrives within deadLetterReplayTimeout
+func replayDeadLetterPartition(partitionConsumer sarama.PartitionConsumer, newest int64) (replayed int, failed int) {
+	timeout := time.NewTimer(deadLetterReplayTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case msg, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return
+			}
+			if replayDeadLetter(msg.Value) {
+				replayed++
+			} else {
+				failed++
+			}
+			if msg.Offset+1 >= newest {
+				return
+			}
+			if !timeout.Stop() {
+				<-timeout.C
+			}
+			timeout.Reset(deadLetterReplayTimeout)
+		case <-timeout.C:
+			log.Println("WARNING: stop dead letter replay of partition; no message within", deadLetterReplayTimeout)
+			return
+		}
+	}
+}
+
+func replayDeadLetter(value []byte) bool {
+	deadLetter := messages.DeadLetter{}
+	err := json.Unmarshal(value, &deadLetter)
+	if err != nil {
+		log.Println("ERROR: invalid dead letter", err, string(value))
+		return false
+	}
+	err = ReplayResponse(deadLetter.Response)
+	if err != nil {
+		log.Println("ERROR: unable to replay dead letter", deadLetter.Topic, deadLetter.Partition, deadLetter.Offset, err)
+		return false
+	}
+	log.Println("replayed dead letter", deadLetter.Topic, deadLetter.Partition, deadLetter.Offset)
+	return true
+}
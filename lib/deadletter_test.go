@@ -0,0 +1,113 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+func TestReplayDeadLetters(t *testing.T) {
+	drcloser, deviceRepoUrl, _ := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, _ := PermsearchMock()
+	defer permcloser()
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	engine.Lock(testCommandTask("task1", "device1"), "worker2")
+
+	response, _ := json.Marshal(messages.ProtocolMsg{WorkerId: "worker2", TaskId: "task1", OutputName: "result"})
+	deadLetter, _ := json.Marshal(messages.DeadLetter{Response: string(response), Error: "invalid response", Topic: "response", Partition: 0, Offset: 42})
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("dlq", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("dlq", 0, sarama.OffsetOldest, 0).
+			SetOffset("dlq", 0, sarama.OffsetNewest, 3), //offsets 1 and 2 are no messages (e.g. transaction markers)
+		"FetchRequest": sarama.NewMockFetchResponse(t, 1).SetVersion(2).
+			SetMessage("dlq", 0, 0, sarama.ByteEncoder(deadLetter)),
+	})
+
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl, DeviceRepoUrl: deviceRepoUrl, AuthEndpoint: authUrl, PermissionsUrl: permUrl, KafkaBootstrap: broker.Addr(), DeadLetterTopic: "dlq"}
+	defaultTimeout := deadLetterReplayTimeout
+	deadLetterReplayTimeout = 200 * time.Millisecond
+	defer func() { deadLetterReplayTimeout = defaultTimeout }()
+	replayed, failed, err := ReplayDeadLetters(sarama.OffsetOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 || failed != 0 {
+		t.Fatal(replayed, failed)
+	}
+	if completion, ok := engine.Completion("task1"); !ok || completion.WorkerId != "worker2" || completion.Variables[CAMUNDA_OUTPUT_NAME].Value.ServiceId != "service1" {
+		t.Fatal(completion)
+	}
+
+	if _, ok := CompleteCamundaTask("not json").(InvalidResponseError); !ok {
+		t.Fatal("expected InvalidResponseError")
+	}
+}
+
+func TestPublishDeadLetter(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	produceResponse := sarama.NewMockProduceResponse(t).SetVersion(2)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("dlq", 0, broker.BrokerID()),
+		"ProduceRequest": produceResponse,
+	})
+	util.Config = &util.ConfigStruct{KafkaBootstrap: broker.Addr(), DeadLetterTopic: "dlq", KafkaRequiredAcks: "none"}
+	SetTransport(KafkaTransport{})
+	defer CloseProducer()
+
+	err := PublishDeadLetter(Response{Value: "foo", Topic: "response", Offset: 1}, errors.New("invalid response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	produceRequests := 0
+	for _, req := range broker.History() {
+		if produce, ok := req.Request.(*sarama.ProduceRequest); ok {
+			produceRequests++
+			if produce.RequiredAcks == sarama.NoResponse {
+				t.Fatal("dead letter without acknowledgement")
+			}
+		}
+	}
+	if produceRequests != 1 {
+		t.Fatal(produceRequests)
+	}
+
+	//the broker rejects the dead letter: the error reaches the caller, which keeps the response
+	produceResponse.SetError("dlq", 0, sarama.ErrMessageSizeTooLarge)
+	err = PublishDeadLetter(Response{Value: "bar", Topic: "response", Offset: 2}, errors.New("invalid response"))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+const (
+	HealthCamunda           = "camunda"
+	HealthKafkaProducer     = "kafka_producer"
+	HealthKafkaConsumer     = "kafka_consumer"
+	HealthDeviceRepository  = "device_repository"
+	HealthPermissionSearch  = "permission_search"
+	HealthKeycloak          = "keycloak"
+	HealthTransport         = "transport"
+	HealthMqtt              = "mqtt"
+	HealthCacheInvalidation = "cache_invalidation"
+)
+
+type HealthCheck struct {
+	Ok       bool      `json:"ok"`
+	Critical bool      `json:"critical"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+type HealthReport struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+var healthChecks = map[string]HealthCheck{}
+var healthMux sync.RWMutex
+
+func ReportHealth(name string, critical bool, err error) {
+	check := HealthCheck{Ok: err == nil, Critical: critical, Time: time.Now()}
+	if err != nil {
+		check.Error = err.Error()
+	}
+	healthMux.Lock()
+	defer healthMux.Unlock()
+	if previous, ok := healthChecks[name]; ok && previous.Ok != check.Ok {
+		log.Println("health of", name, "changed; ok =", check.Ok, check.Error)
+	}
+	healthChecks[name] = check
+}
+
+func GetHealthReport() (report HealthReport) {
+	healthMux.RLock()
+	defer healthMux.RUnlock()
+	report.Ready = true
+	report.Checks = map[string]HealthCheck{}
+	for name, check := range healthChecks {
+		report.Checks[name] = check
+		if check.Critical && !check.Ok {
+			report.Ready = false
+		}
+	}
+	return
+}
+
+//false while a critical dependency is reported as down; the camunda worker pauses fetching in this case
+func CriticalDependenciesUp() bool {
+	return GetHealthReport().Ready
+}
+
+//active probes of the health monitor; the kafka producer and consumer report their state themselves
+var healthProbes = map[string]func() error{
+	HealthTransport: func() error {
+		return GetTransport().Health()
+	},
+	HealthCamunda: func() error {
+		return probeUrl(util.Config.CamundaUrl + "/engine")
+	},
+	HealthDeviceRepository: func() error {
+		return probeUrl(util.Config.DeviceRepoUrl)
+	},
+	HealthPermissionSearch: func() error {
+		return probeUrl(util.Config.PermissionsUrl)
+	},
+	HealthKeycloak: func() error {
+		token, err := EnsureAccess()
+		if err == nil && token == "Bearer " {
+			err = errors.New("missing access token")
+		}
+		return err
+	},
+}
+
+//any response below 500 counts as reachable
+func probeUrl(url string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return errors.New("unexpected statuscode " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+func runHealthProbes() {
+	wg := sync.WaitGroup{}
+	for name, probe := range healthProbes {
+		wg.Add(1)
+		go func(name string, probe func() error) {
+			defer wg.Done()
+			ReportHealth(name, true, probe())
+		}(name, probe)
+	}
+	wg.Wait()
+}
+
+//probes the dependencies every HealthCheckInterval ms until ctx is done
+func HealthMonitor(ctx context.Context) {
+	interval := time.Duration(util.Config.HealthCheckInterval) * time.Millisecond
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	runHealthProbes()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			runHealthProbes()
+		}
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+)
+
+//part of the lock duration that is left for the completion of the task
+const httpCommandCompletionShare = 4
+
+//a ProtocolHandlerUrl with http(s) scheme is called synchronously instead of publishing the command to a topic
+func IsHttpProtocolHandler(protocolHandlerUrl string) bool {
+	lower := strings.ToLower(protocolHandlerUrl)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+//the protocol handler has to answer before the lock expires; the last quarter of the lock is reserved for the completion
+//the lock started with the fetch of the task (LockTime), the time spent since then is not available to the protocol handler
+func getHttpCommandTimeout(task messages.CamundaTask) time.Duration {
+	lockDuration := time.Duration(getLockDuration(task)) * time.Millisecond
+	if lockDuration <= 0 {
+		lockDuration = time.Minute
+	}
+	lockTime := task.LockTime
+	if lockTime.IsZero() {
+		lockTime = time.Now()
+	}
+	return time.Until(lockTime.Add(lockDuration - lockDuration/httpCommandCompletionShare))
+}
+
+//POSTs the envelope of command to its ProtocolHandlerUrl and completes the task with the returned ProtocolMsg
+func ExecuteHttpCommand(task messages.CamundaTask, command CommandMessage, service model.Service) {
+	start := time.Now()
+	log.Println("send command", task.Id, HeaderTraceId, command.Headers[HeaderTraceId])
+	nrMsg, executed, err := callHttpProtocolHandler(task, command)
+	observeDependency(DependencyProtocolHandler, start)
+	if err != nil {
+		log.Println("ERROR: http protocol handler", command.Topic, task.Id, err)
+		if util.Config.QosStrategy == "<=" {
+			if executed {
+				//a retry could execute the command twice
+				err = NewFinalTaskError(GetErrorClass(err), err.Error())
+			} else if err := UnmarkCommandSent(task); err != nil {
+				log.Println("ERROR: unable to reset the sent marker", task.Id, err)
+			}
+		}
+		HandleTaskError(task, err)
+		return
+	}
+	inFlightTask := InFlightTask{
+		Task:         task,
+		WorkerId:     GetWorkerId(),
+		Service:      service,
+		OutputName:   CAMUNDA_OUTPUT_NAME,
+		LockDuration: getLockDuration(task),
+		SendTime:     start,
+		TraceId:      command.Headers[HeaderTraceId],
+	}
+	err = completeResponse(nrMsg, inFlightTask)
+	if invalid, ok := err.(InvalidResponseError); ok {
+		HandleTaskError(task, NewTaskError(ErrorClassProtocolError, invalid.Error()))
+		return
+	}
+	if err != nil {
+		//camunda hands the task out again after the lock expired
+		log.Println("ERROR: unable to complete task of http protocol handler", task.Id, err)
+	}
+}
+
+//executed is true if the command may have reached the device although an error is returned (e.g. timeout or server error)
+func callHttpProtocolHandler(task messages.CamundaTask, command CommandMessage) (nrMsg messages.ProtocolMsg, executed bool, err error) {
+	timeout := getHttpCommandTimeout(task)
+	if timeout <= 0 {
+		return nrMsg, false, NewTaskError(ErrorClassTimeout, "no lock time left for the protocol handler")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", command.Topic, bytes.NewBufferString(command.Value))
+	if err != nil {
+		return nrMsg, false, NewFinalTaskError(ErrorClassProtocolError, "invalid protocol handler url: "+err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nrMsg, true, NewTaskError(ErrorClassTimeout, "protocol handler timeout")
+		}
+		return nrMsg, !isHttpConnectError(err), NewTaskError(ErrorClassUnavailable, "protocol handler not reachable: "+err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nrMsg, true, NewTaskError(ErrorClassUnavailable, "protocol handler error: "+strconv.Itoa(resp.StatusCode)+" "+string(body))
+	}
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nrMsg, false, NewTaskError(ErrorClassProtocolError, "protocol handler rejected command: "+strconv.Itoa(resp.StatusCode)+" "+string(body))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&nrMsg)
+	if err != nil {
+		return nrMsg, true, NewTaskError(ErrorClassProtocolError, "invalid protocol handler response: "+err.Error())
+	}
+	return nrMsg, true, nil
+}
+
+//the request failed before the connection to the protocol handler has been established
+func isHttpConnectError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
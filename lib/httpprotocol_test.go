@@ -0,0 +1,134 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+)
+
+func TestExecuteHttpCommand(t *testing.T) {
+	camundaCalls := NewMockCalls()
+	failures := map[string]messages.CamundaError{}
+	failuresMux := sync.Mutex{}
+	camunda := httptest.NewServer(camundaCalls.Handler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if strings.HasSuffix(request.URL.Path, "/failure") {
+			failure := messages.CamundaError{}
+			json.NewDecoder(request.Body).Decode(&failure)
+			failuresMux.Lock()
+			failures[request.URL.Path] = failure
+			failuresMux.Unlock()
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	})))
+	defer camunda.Close()
+
+	handlerCalls := NewMockCalls()
+	protocolHandler := httptest.NewServer(handlerCalls.Handler(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		envelope := Envelope{}
+		err := json.NewDecoder(request.Body).Decode(&envelope)
+		if err != nil {
+			t.Error(err)
+		}
+		switch envelope.DeviceId {
+		case "failing":
+			writer.WriteHeader(http.StatusInternalServerError)
+		case "slow":
+			time.Sleep(500 * time.Millisecond)
+			json.NewEncoder(writer).Encode(messages.ProtocolMsg{TaskId: "task3"})
+		default:
+			json.NewEncoder(writer).Encode(messages.ProtocolMsg{TaskId: "task1"})
+		}
+	})))
+	defer protocolHandler.Close()
+
+	util.Config = &util.ConfigStruct{CamundaUrl: camunda.URL, CamundaFetchLockDuration: 400, CamundaRetries: 3}
+	if !IsHttpProtocolHandler(protocolHandler.URL) || IsHttpProtocolHandler("protocol1") {
+		t.Fatal("unexpected protocol handler detection")
+	}
+	if timeout := getHttpCommandTimeout(messages.CamundaTask{}); timeout > 300*time.Millisecond || timeout < 250*time.Millisecond {
+		t.Fatal(timeout)
+	}
+	//the time since the fetch is not available to the protocol handler
+	if timeout := getHttpCommandTimeout(messages.CamundaTask{LockTime: time.Now().Add(-200 * time.Millisecond)}); timeout > 100*time.Millisecond || timeout < 50*time.Millisecond {
+		t.Fatal(timeout)
+	}
+
+	send := func(taskId string, deviceId string) {
+		value, _ := json.Marshal(Envelope{DeviceId: deviceId, ServiceId: "service1"})
+		ExecuteHttpCommand(messages.CamundaTask{Id: taskId, ExecutionId: "execution-" + taskId}, CommandMessage{Topic: protocolHandler.URL, Value: string(value)}, model.Service{Id: "service1"})
+	}
+	send("task1", "device1")
+	if camundaCalls.Get("/external-task/task1/complete") != 1 {
+		t.Fatal("missing completion of task1")
+	}
+	send("task2", "failing")
+	if camundaCalls.Get("/external-task/task2/failure") != 1 || camundaCalls.Get("/external-task/task2/complete") != 0 {
+		t.Fatal("missing failure of task2")
+	}
+	start := time.Now()
+	send("task3", "slow")
+	if time.Since(start) >= 500*time.Millisecond {
+		t.Fatal("protocol handler timeout not applied", time.Since(start))
+	}
+	if camundaCalls.Get("/external-task/task3/failure") != 1 || camundaCalls.Get("/external-task/task3/complete") != 0 {
+		t.Fatal("missing failure of task3")
+	}
+	if handlerCalls.Get("/") != 3 {
+		t.Fatal("unexpected protocol handler calls", handlerCalls.Get("/"))
+	}
+
+	//lock nearly expired: the protocol handler is not called
+	value, _ := json.Marshal(Envelope{DeviceId: "device1", ServiceId: "service1"})
+	ExecuteHttpCommand(messages.CamundaTask{Id: "task4", LockTime: time.Now().Add(-350 * time.Millisecond)}, CommandMessage{Topic: protocolHandler.URL, Value: string(value)}, model.Service{Id: "service1"})
+	if handlerCalls.Get("/") != 3 || camundaCalls.Get("/external-task/task4/failure") != 1 {
+		t.Fatal("protocol handler called without lock time left")
+	}
+
+	//at most once: errors after the command may have been executed are final, other errors reset the sent marker
+	util.Config.QosStrategy = "<="
+	failure := func(taskId string) messages.CamundaError {
+		failuresMux.Lock()
+		defer failuresMux.Unlock()
+		return failures["/external-task/"+taskId+"/failure"]
+	}
+	if failure("task2").Retries != 3 {
+		t.Fatal("server error should be retried without qos strategy", failure("task2"))
+	}
+	send("task5", "failing")
+	if failure("task5").Retries != 0 || camundaCalls.Get("/execution/execution-task5/localVariables/"+CAMUNDA_VARIABLES_COMMAND_SENT) != 0 {
+		t.Fatal("server error should be final", failure("task5"))
+	}
+	send("task6", "slow")
+	if failure("task6").Retries != 0 {
+		t.Fatal("timeout should be final", failure("task6"))
+	}
+	protocolHandler.Close()
+	send("task7", "device1")
+	if failure("task7").Retries != 3 || camundaCalls.Get("/execution/execution-task7/localVariables/"+CAMUNDA_VARIABLES_COMMAND_SENT) != 1 {
+		t.Fatal("unreachable protocol handler should be retried", failure("task7"))
+	}
+}
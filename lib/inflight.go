@@ -0,0 +1,245 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+)
+
+//task that has been sent to a protocol handler and waits for its response
+type InFlightTask struct {
+	Task         messages.CamundaTask
+	WorkerId     string //lock owner
+	Device       model.DeviceInstance
+	Service      model.Service
+	OutputName   string
+	LockDuration int64 //ms
+	SendTime     time.Time
+	Deadline     time.Time //no response is expected after this time
+	TraceId      string    //HeaderTraceId of the command
+}
+
+type InFlightStats struct {
+	Accepted       uint64
+	Unknown        uint64
+	Duplicate      uint64
+	Foreign        uint64
+	ForeignDropped uint64
+	Expired        uint64
+}
+
+var ErrUnknownResponse = errors.New("response for unknown task")
+var ErrDuplicateResponse = errors.New("duplicate or late response")
+
+//how long ids of closed tasks are remembered to recognize duplicate responses
+var ClosedTaskRetention = 10 * time.Minute
+
+type InFlightRegistry struct {
+	mux         sync.Mutex
+	tasks       map[string]InFlightTask
+	closed      map[string]time.Time
+	unanswered  map[string]time.Time //sent tasks that expired without response; see TakeUnanswered
+	stats       InFlightStats
+	persistence InFlightPersistence
+	persistMux  sync.Mutex //serializes writes to persistence; held without mux
+}
+
+func NewInFlightRegistry() *InFlightRegistry {
+	return &InFlightRegistry{tasks: map[string]InFlightTask{}, closed: map[string]time.Time{}, unanswered: map[string]time.Time{}}
+}
+
+var inFlight = NewInFlightRegistry()
+
+func GetInFlightRegistry() *InFlightRegistry {
+	return inFlight
+}
+
+func (this *InFlightRegistry) SetPersistence(persistence InFlightPersistence) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.persistence = persistence
+}
+
+func (this *InFlightRegistry) Add(task InFlightTask) {
+	this.mux.Lock()
+	this.tasks[task.Task.Id] = task
+	delete(this.closed, task.Task.Id)
+	this.mux.Unlock()
+	this.persist(task.Task.Id)
+}
+
+//has to be called with mux; the caller persists the change after releasing mux
+func (this *InFlightRegistry) remove(taskId string) {
+	delete(this.tasks, taskId)
+	this.closed[taskId] = time.Now()
+}
+
+//writes the current state of the task to the persistence; the fsync of the store does not block the registry,
+//concurrent writes for the same task are serialized and always store the latest state
+func (this *InFlightRegistry) persist(taskId string) {
+	this.persistMux.Lock()
+	defer this.persistMux.Unlock()
+	this.mux.Lock()
+	task, inFlight := this.tasks[taskId]
+	persistence := this.persistence
+	this.mux.Unlock()
+	if persistence == nil {
+		return
+	}
+	if inFlight {
+		if err := persistence.Save(task); err != nil {
+			log.Println("ERROR: unable to persist in-flight task", taskId, err)
+		}
+		return
+	}
+	if err := persistence.Delete(taskId); err != nil {
+		log.Println("ERROR: unable to delete persisted in-flight task", taskId, err)
+	}
+}
+
+func (this *InFlightRegistry) Get(taskId string) (task InFlightTask, ok bool) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	task, ok = this.tasks[taskId]
+	return
+}
+
+//removes the task without expecting a response (e.g. send error or expired lock); later responses count as duplicates
+func (this *InFlightRegistry) Close(taskId string) (task InFlightTask, ok bool) {
+	this.mux.Lock()
+	task, ok = this.tasks[taskId]
+	if ok {
+		this.remove(taskId)
+	}
+	this.mux.Unlock()
+	if ok {
+		this.persist(taskId)
+	}
+	return
+}
+
+func (this *InFlightRegistry) Expire(taskId string) (task InFlightTask, ok bool) {
+	task, ok = this.Close(taskId)
+	if ok {
+		atomic.AddUint64(&this.stats.Expired, 1)
+		this.MarkUnanswered(taskId)
+	}
+	return
+}
+
+//remembers a sent task without response for ClosedTaskRetention (e.g. a released task of the in-flight store)
+func (this *InFlightRegistry) MarkUnanswered(taskId string) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.unanswered[taskId] = time.Now()
+}
+
+//true if the command of the task has been sent without response: the task is still in flight or expired;
+//camunda hands such a task out again after its lock expired, which the <= qos strategy has to recognize.
+//the task is closed and the mark removed, so a later retry of the task (e.g. after an incident) is sent again
+func (this *InFlightRegistry) TakeUnanswered(taskId string) (sent bool) {
+	this.mux.Lock()
+	_, inFlight := this.tasks[taskId]
+	if inFlight {
+		this.remove(taskId)
+	}
+	_, expired := this.unanswered[taskId]
+	delete(this.unanswered, taskId)
+	this.mux.Unlock()
+	if inFlight {
+		this.persist(taskId)
+	}
+	return inFlight || expired
+}
+
+//correlates a response with its in-flight task; every task accepts only one response
+func (this *InFlightRegistry) Resolve(taskId string) (task InFlightTask, err error) {
+	this.mux.Lock()
+	task, ok := this.tasks[taskId]
+	if ok {
+		this.remove(taskId)
+		this.mux.Unlock()
+		this.persist(taskId)
+		atomic.AddUint64(&this.stats.Accepted, 1)
+		return task, nil
+	}
+	defer this.mux.Unlock()
+	if _, ok := this.closed[taskId]; ok {
+		atomic.AddUint64(&this.stats.Duplicate, 1)
+		return task, ErrDuplicateResponse
+	}
+	atomic.AddUint64(&this.stats.Unknown, 1)
+	return task, ErrUnknownResponse
+}
+
+//counts responses for tasks sent by other worker instances
+func (this *InFlightRegistry) CountForeign() {
+	atomic.AddUint64(&this.stats.Foreign, 1)
+}
+
+//counts responses of other worker instances that could not be verified or are not accepted
+func (this *InFlightRegistry) CountForeignDropped() {
+	atomic.AddUint64(&this.stats.ForeignDropped, 1)
+}
+
+func (this *InFlightRegistry) PruneClosed(retention time.Duration) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for taskId, closed := range this.closed {
+		if time.Since(closed) > retention {
+			delete(this.closed, taskId)
+		}
+	}
+	for taskId, expired := range this.unanswered {
+		if time.Since(expired) > retention {
+			delete(this.unanswered, taskId)
+		}
+	}
+}
+
+func (this *InFlightRegistry) List() (result []InFlightTask) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for _, task := range this.tasks {
+		result = append(result, task)
+	}
+	return
+}
+
+func (this *InFlightRegistry) Len() int {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return len(this.tasks)
+}
+
+func (this *InFlightRegistry) Stats() InFlightStats {
+	return InFlightStats{
+		Accepted:       atomic.LoadUint64(&this.stats.Accepted),
+		Unknown:        atomic.LoadUint64(&this.stats.Unknown),
+		Duplicate:      atomic.LoadUint64(&this.stats.Duplicate),
+		Foreign:        atomic.LoadUint64(&this.stats.Foreign),
+		ForeignDropped: atomic.LoadUint64(&this.stats.ForeignDropped),
+		Expired:        atomic.LoadUint64(&this.stats.Expired),
+	}
+}
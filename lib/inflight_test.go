@@ -0,0 +1,57 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+)
+
+func TestInFlightRegistry(t *testing.T) {
+	registry := NewInFlightRegistry()
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "task1"}, SendTime: time.Now()})
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "task2"}, SendTime: time.Now()})
+
+	task, err := registry.Resolve("task1")
+	if err != nil || task.Task.Id != "task1" {
+		t.Fatal(task, err)
+	}
+	_, err = registry.Resolve("task1")
+	if err != ErrDuplicateResponse {
+		t.Fatal(err)
+	}
+	_, err = registry.Resolve("unknown")
+	if err != ErrUnknownResponse {
+		t.Fatal(err)
+	}
+	registry.Expire("task2")
+	_, err = registry.Resolve("task2")
+	if err != ErrDuplicateResponse {
+		t.Fatal(err)
+	}
+	registry.PruneClosed(0)
+	_, err = registry.Resolve("task1")
+	if err != ErrUnknownResponse {
+		t.Fatal(err)
+	}
+	stats := registry.Stats()
+	if stats.Accepted != 1 || stats.Duplicate != 2 || stats.Unknown != 2 || stats.Expired != 1 || registry.Len() != 0 {
+		t.Fatal(stats, registry.Len())
+	}
+}
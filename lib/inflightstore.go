@@ -0,0 +1,162 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+var inFlightBucket = []byte("inflight")
+var metaBucket = []byte("meta")
+var workerIdKey = []byte("worker_id")
+
+type InFlightPersistence interface {
+	Save(task InFlightTask) error
+	Delete(taskId string) error
+}
+
+//persists in-flight tasks in an embedded bbolt db
+type InFlightStore struct {
+	db *bolt.DB
+}
+
+func OpenInFlightStore(path string) (store *InFlightStore, err error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return store, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(inFlightBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return store, err
+	}
+	return &InFlightStore{db: db}, nil
+}
+
+func (this *InFlightStore) Save(task InFlightTask) error {
+	value, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inFlightBucket).Put([]byte(task.Task.Id), value)
+	})
+}
+
+func (this *InFlightStore) Delete(taskId string) error {
+	return this.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inFlightBucket).Delete([]byte(taskId))
+	})
+}
+
+func (this *InFlightStore) Load() (result []InFlightTask, err error) {
+	err = this.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(inFlightBucket).ForEach(func(key, value []byte) error {
+			task := InFlightTask{}
+			if err := json.Unmarshal(value, &task); err != nil {
+				log.Println("ERROR: unable to parse stored in-flight task; ignore", string(key), err)
+				return nil
+			}
+			result = append(result, task)
+			return nil
+		})
+	})
+	return
+}
+
+//returns the stored worker id; stores the given id if none exists
+func (this *InFlightStore) WorkerId(defaultId string) (workerId string, err error) {
+	err = this.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(metaBucket)
+		if stored := bucket.Get(workerIdKey); len(stored) > 0 {
+			workerId = string(stored)
+			return nil
+		}
+		workerId = defaultId
+		return bucket.Put(workerIdKey, []byte(defaultId))
+	})
+	return
+}
+
+func (this *InFlightStore) Close() error {
+	return this.db.Close()
+}
+
+var inFlightStore *InFlightStore
+
+//opens the store configured by InFlightStorePath and resumes the stored tasks;
+//tasks after their deadline are unlocked so camunda can hand them out again
+func InitInFlightStore() (err error) {
+	if util.Config.InFlightStorePath == "" {
+		return nil
+	}
+	inFlightStore, err = OpenInFlightStore(util.Config.InFlightStorePath)
+	if err != nil {
+		return err
+	}
+	if util.Config.WorkerId == "" {
+		id, err := inFlightStore.WorkerId(GetWorkerId())
+		if err != nil {
+			return err
+		}
+		SetWorkerId(id)
+	}
+	tasks, err := inFlightStore.Load()
+	if err != nil {
+		return err
+	}
+	registry := GetInFlightRegistry()
+	registry.SetPersistence(inFlightStore)
+	for _, task := range tasks {
+		if task.WorkerId != GetWorkerId() || time.Now().After(task.Deadline) {
+			log.Println("release stored in-flight task", task.Task.Id)
+			registry.MarkUnanswered(task.Task.Id)
+			if err := UnlockCamundaTask(task.Task.Id); err != nil && !IsCamundaTaskNotFound(err) {
+				log.Println("WARNING: unable to unlock stored in-flight task", task.Task.Id, err)
+			}
+			inFlightStore.Delete(task.Task.Id)
+			continue
+		}
+		if err := ExtendCamundaLock(task.Task.Id, task.LockDuration); IsCamundaTaskGone(err) {
+			log.Println("WARNING: lock of stored in-flight task lost", task.Task.Id, err)
+			inFlightStore.Delete(task.Task.Id)
+			continue
+		} else if err != nil {
+			log.Println("WARNING: unable to extend lock of stored in-flight task; the supervisor tries again", task.Task.Id, err)
+		}
+		log.Println("resume stored in-flight task", task.Task.Id)
+		registry.Add(task)
+	}
+	return nil
+}
+
+func CloseInFlightStore() {
+	if inFlightStore != nil {
+		inFlightStore.Close()
+	}
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
+)
+
+func TestInFlightStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inflight.db")
+
+	store, err := OpenInFlightStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	workerId, err := store.WorkerId("worker1")
+	if err != nil || workerId != "worker1" {
+		t.Fatal(workerId, err)
+	}
+	registry := NewInFlightRegistry()
+	registry.SetPersistence(store)
+	deadline := time.Now().Add(time.Minute).Round(0)
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "task1"}, Service: model.Service{Id: "service1"}, Deadline: deadline})
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "task2"}, Deadline: deadline})
+	registry.Resolve("task2")
+	store.Close()
+
+	store, err = OpenInFlightStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	workerId, err = store.WorkerId("worker2")
+	if err != nil || workerId != "worker1" {
+		t.Fatal(workerId, err)
+	}
+	tasks, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Task.Id != "task1" || tasks[0].Service.Id != "service1" || !tasks[0].Deadline.Equal(deadline) {
+		t.Fatal(tasks)
+	}
+}
+
+func TestInitInFlightStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inflight")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "inflight.db")
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl, InFlightStorePath: path}
+
+	store, err := OpenInFlightStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.WorkerId(GetWorkerId()); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	stored := []InFlightTask{
+		{Task: messages.CamundaTask{Id: "resume"}, WorkerId: GetWorkerId(), Deadline: future, LockDuration: 1000},
+		{Task: messages.CamundaTask{Id: "lost"}, WorkerId: GetWorkerId(), Deadline: future, LockDuration: 1000},
+		{Task: messages.CamundaTask{Id: "expired"}, WorkerId: GetWorkerId(), Deadline: time.Now().Add(-time.Minute)},
+		{Task: messages.CamundaTask{Id: "foreign"}, WorkerId: "worker2", Deadline: future},
+	}
+	for _, task := range stored {
+		if err = store.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+	engine.Lock(messages.CamundaTask{Id: "resume"}, GetWorkerId())
+	engine.Lock(messages.CamundaTask{Id: "lost"}, "other-worker")
+	engine.Lock(messages.CamundaTask{Id: "expired"}, GetWorkerId())
+
+	err = InitInFlightStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := GetInFlightRegistry()
+	defer func() {
+		registry.Close("resume")
+		registry.SetPersistence(nil)
+		CloseInFlightStore()
+		inFlightStore = nil
+	}()
+
+	//resume: the lock is extended and the task waits for its response
+	if _, ok := registry.Get("resume"); !ok || engine.Get("/external-task/resume/extendLock") != 1 {
+		t.Fatal("task not resumed")
+	}
+	//extend lock: camunda handed the task to another worker
+	if _, ok := registry.Get("lost"); ok || engine.Get("/external-task/lost/extendLock") != 1 {
+		t.Fatal("task with lost lock resumed")
+	}
+	//unlock: deadline passed or stored by another worker; an unknown task is ignored
+	if _, ok := registry.Get("expired"); ok || engine.Locked("expired") {
+		t.Fatal("expired task not released")
+	}
+	if engine.Get("/external-task/foreign/unlock") != 1 {
+		t.Fatal("task of other worker not released")
+	}
+	if !registry.TakeUnanswered("expired") || !registry.TakeUnanswered("foreign") {
+		t.Fatal("released tasks may not be sent again with the <= qos strategy")
+	}
+
+	tasks, err := inFlightStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Task.Id != "resume" {
+		t.Fatal(tasks)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func LockExtensionEnabled() bool {
+	return util.Config.CamundaMaxExecutionTime > 0
+}
+
+const minLockExtensionInterval = 100 * time.Millisecond
+
+//half of the shortest lock duration of all topics; a longer CamundaLockExtensionInterval would let these locks expire
+func getLockExtensionInterval() (interval time.Duration) {
+	lockDuration := util.Config.CamundaFetchLockDuration
+	for _, topic := range GetTopics() {
+		if topic.LockDuration > 0 && (lockDuration <= 0 || topic.LockDuration < lockDuration) {
+			lockDuration = topic.LockDuration
+		}
+	}
+	interval = time.Duration(lockDuration/2) * time.Millisecond
+	configured := time.Duration(util.Config.CamundaLockExtensionInterval) * time.Millisecond
+	if configured > 0 && (configured < interval || interval <= 0) {
+		interval = configured
+	}
+	if interval < minLockExtensionInterval {
+		interval = minLockExtensionInterval
+	}
+	return interval
+}
+
+//time after which a response for a sent command is no longer expected
+func getMaxResponseTime() time.Duration {
+	if LockExtensionEnabled() && util.Config.CamundaMaxExecutionTime > util.Config.CamundaFetchLockDuration {
+		return time.Duration(util.Config.CamundaMaxExecutionTime) * time.Millisecond
+	}
+	return time.Duration(util.Config.CamundaFetchLockDuration) * time.Millisecond
+}
+
+//expires in-flight tasks without response and extends the locks of the others if LockExtensionEnabled()
+func InFlightSupervisor(ctx context.Context) {
+	log.Println("start in-flight task supervisor")
+	for {
+		//topics may be registered later; so the interval is checked before every run
+		timer := time.NewTimer(getLockExtensionInterval())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			SuperviseInFlightTasks()
+		}
+	}
+}
+
+func SuperviseInFlightTasks() {
+	registry := GetInFlightRegistry()
+	for _, task := range registry.List() {
+		if !time.Now().Before(task.Deadline) {
+			log.Println("WARNING: no response in time; stop waiting for", task.Task.Id)
+			registry.Expire(task.Task.Id)
+			continue
+		}
+		if !LockExtensionEnabled() {
+			continue
+		}
+		err := ExtendCamundaLock(task.Task.Id, task.LockDuration)
+		if IsCamundaTaskGone(err) {
+			log.Println("WARNING: lock lost; stop waiting for", task.Task.Id, err)
+			registry.Expire(task.Task.Id)
+		} else if err != nil {
+			//the lock may still be valid; try again with the next check
+			log.Println("ERROR: unable to extend lock of", task.Task.Id, err)
+		}
+	}
+	registry.PruneClosed(ClosedTaskRetention)
+}
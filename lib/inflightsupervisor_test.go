@@ -0,0 +1,100 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestSuperviseInFlightTasks(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl, CamundaFetchLockDuration: 1000, CamundaMaxExecutionTime: 5000}
+	if !LockExtensionEnabled() || getMaxResponseTime() != 5*time.Second || getLockExtensionInterval() != 500*time.Millisecond {
+		t.Fatal("unexpected lock extension settings", getMaxResponseTime(), getLockExtensionInterval())
+	}
+
+	registry := GetInFlightRegistry()
+	for _, id := range []string{"running", "lost", "late"} {
+		deadline := time.Now().Add(time.Minute)
+		if id == "late" {
+			deadline = time.Now().Add(-time.Second)
+		}
+		registry.Add(InFlightTask{Task: messages.CamundaTask{Id: id}, WorkerId: GetWorkerId(), LockDuration: 1000, Deadline: deadline})
+		defer registry.Close(id)
+	}
+	engine.Lock(messages.CamundaTask{Id: "running"}, GetWorkerId())
+	engine.Lock(messages.CamundaTask{Id: "lost"}, "other-worker")
+	engine.Lock(messages.CamundaTask{Id: "late"}, GetWorkerId())
+
+	SuperviseInFlightTasks()
+	//running: lock extended, still waiting for the response
+	if _, ok := registry.Get("running"); !ok || engine.Get("/external-task/running/extendLock") != 1 {
+		t.Fatal("lock of running task not extended")
+	}
+	//lost: camunda handed the task to another worker
+	if _, ok := registry.Get("lost"); ok {
+		t.Fatal("task with lost lock still in flight")
+	}
+	//late: deadline passed, the lock is not extended anymore
+	if _, ok := registry.Get("late"); ok || engine.Get("/external-task/late/extendLock") != 0 {
+		t.Fatal("late task still in flight")
+	}
+
+	//without lock extension only the deadline is checked
+	util.Config.CamundaMaxExecutionTime = 0
+	if LockExtensionEnabled() || getMaxResponseTime() != time.Second {
+		t.Fatal("unexpected lock extension settings", getMaxResponseTime())
+	}
+	SuperviseInFlightTasks()
+	if _, ok := registry.Get("running"); !ok || engine.Get("/external-task/running/extendLock") != 1 {
+		t.Fatal("lock extended although disabled")
+	}
+}
+
+func TestLockExtensionInterval(t *testing.T) {
+	util.Config = &util.ConfigStruct{CamundaFetchLockDuration: 10000, CamundaLockExtensionInterval: 2000}
+	if interval := getLockExtensionInterval(); interval != 2*time.Second {
+		t.Fatal(interval)
+	}
+
+	//topics with a shorter lock duration shorten the interval
+	defer UnregisterTopic("short")
+	RegisterTopic(Topic{Name: "short", LockDuration: 1000})
+	if interval := getLockExtensionInterval(); interval != 500*time.Millisecond {
+		t.Fatal(interval)
+	}
+	util.Config.CamundaLockExtensionInterval = 0
+	if interval := getLockExtensionInterval(); interval != 500*time.Millisecond {
+		t.Fatal(interval)
+	}
+	UnregisterTopic("short")
+
+	//no zero interval for tiny lock durations
+	util.Config.CamundaFetchLockDuration = 1
+	if interval := getLockExtensionInterval(); interval != minLockExtensionInterval {
+		t.Fatal(interval)
+	}
+	util.Config.CamundaFetchLockDuration = 0
+	if interval := getLockExtensionInterval(); interval != minLockExtensionInterval {
+		t.Fatal(interval)
+	}
+}
@@ -17,11 +17,13 @@
 package lib
 
 import (
+	"bytes"
 	"encoding/json"
 	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
 	"log"
 	"net/url"
 	"sync"
+	"time"
 
 	"errors"
 
@@ -48,46 +50,93 @@ func NewIot(url string) (*Iot){
 	return &Iot{url: url, cache:NewCache()}
 }
 
+var ErrAccessDenied = errors.New("user may not execute events for the resource")
+
+//cache value for devices and services the repository does not know
+var negativeCacheValue = []byte("!notfound")
+
 func (this *Iot) GetDeviceInstance(token JwtImpersonate, deviceInstanceId string) (result model.DeviceInstance, err error) {
 	if err = this.CheckExecutionAccess(token, deviceInstanceId); err == nil {
 		result, err = this.getDeviceFromCache(deviceInstanceId)
-		if err != nil {
+		if err == ErrNotFound {
+			start := time.Now()
 			err = token.GetJSON(this.url+"/devices/"+url.QueryEscape(deviceInstanceId), &result)
+			observeDependency(DependencyDeviceRepository, start)
+			this.setCache("device."+deviceInstanceId, result, err, util.Config.DeviceCacheExpiration)
 		}
 	}
 	return
 }
 
 func (this *Iot) getDeviceFromCache(id string) (device model.DeviceInstance, err error) {
-	item, err := this.cache.Get("device."+id)
+	item, err := this.cache.Get("device." + id)
 	if err != nil {
-		return device, err
+		return device, ErrNotFound
+	}
+	if bytes.Equal(item.Value, negativeCacheValue) {
+		return device, ErrResourceNotFound
 	}
 	err = json.Unmarshal(item.Value, &device)
+	if err != nil {
+		return device, ErrNotFound
+	}
 	return
 }
 
 func (this *Iot) getServiceFromCache(id string) (service model.Service, err error) {
-	item, err := this.cache.Get("service."+id)
+	item, err := this.cache.Get("service." + id)
 	if err != nil {
-		return service, err
+		return service, ErrNotFound
+	}
+	if bytes.Equal(item.Value, negativeCacheValue) {
+		return service, ErrResourceNotFound
 	}
 	err = json.Unmarshal(item.Value, &service)
+	if err != nil {
+		return service, ErrNotFound
+	}
 	return
 }
 
 func (this *Iot) GetDeviceService(token JwtImpersonate, serviceId string) (result model.Service, err error) {
 	result, err = this.getServiceFromCache(serviceId)
-	if err != nil {
+	if err == ErrNotFound {
+		start := time.Now()
 		err = token.GetJSON(this.url+"/services/"+url.QueryEscape(serviceId), &result)
+		observeDependency(DependencyDeviceRepository, start)
+		this.setCache("service."+serviceId, result, err, util.Config.ServiceCacheExpiration)
 	}
 	return
 }
 
+//stores successful results with the given expiration and 404 results with NegativeCacheExpiration; other errors are not cached
+func (this *Iot) setCache(key string, value interface{}, err error, expiration int64) {
+	if err == ErrResourceNotFound {
+		if util.Config.NegativeCacheExpiration > 0 {
+			this.cache.Set(key, negativeCacheValue, int32(util.Config.NegativeCacheExpiration))
+		}
+		return
+	}
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		log.Println("ERROR: unable to marshal cache value", key, err)
+		return
+	}
+	this.cache.Set(key, b, int32(expiration))
+}
+
 func (this *Iot) CheckExecutionAccess(token JwtImpersonate, deviceId string) (err error) {
 	result, err := this.getAccessFromCache(token, deviceId)
-	if err != nil {
-		err = token.GetJSON(util.Config.PermissionsUrl + "/jwt/check/deviceinstance/" + url.QueryEscape(deviceId) + "/x/bool", &result)
+	if err == ErrNotFound {
+		start := time.Now()
+		err = token.GetJSON(util.Config.PermissionsUrl+"/jwt/check/deviceinstance/"+url.QueryEscape(deviceId)+"/x/bool", &result)
+		observeDependency(DependencyPermissionSearch, start)
+		if err == nil {
+			this.setAccessCache(token, deviceId, result)
+		}
 	}
 	if err != nil {
 		return err
@@ -95,19 +144,51 @@ func (this *Iot) CheckExecutionAccess(token JwtImpersonate, deviceId string) (er
 	if result {
 		return nil
 	}else{
-		return errors.New("user may not execute events for the resource")
+		return ErrAccessDenied
 	}
 }
 
+func getAccessCacheKey(token JwtImpersonate, id string) string {
+	return "check.device." + token.Subject() + "." + id
+}
+
 func (this *Iot) getAccessFromCache(token JwtImpersonate, id string) (result bool, err error) {
-	item, err := this.cache.Get("check.device."+string(token)+"."+id)
+	item, err := this.cache.Get(getAccessCacheKey(token, id))
 	if err != nil {
-		return result, err
+		return result, ErrNotFound
 	}
 	err = json.Unmarshal(item.Value, &result)
+	if err != nil {
+		return result, ErrNotFound
+	}
 	return
 }
 
+func (this *Iot) setAccessCache(token JwtImpersonate, id string, access bool) {
+	expiration := util.Config.PermissionCacheExpiration
+	if !access {
+		if util.Config.NegativeCacheExpiration <= 0 {
+			return
+		}
+		expiration = util.Config.NegativeCacheExpiration
+	}
+	b, _ := json.Marshal(access)
+	this.cache.Set(getAccessCacheKey(token, id), b, int32(expiration))
+}
+
+func (this *Iot) InvalidateDevice(id string) {
+	this.cache.Del("device." + id)
+	this.InvalidateDeviceAccess(id)
+}
+
+func (this *Iot) InvalidateDeviceAccess(id string) {
+	this.cache.DelMatching("check.device.", "."+id)
+}
+
+func (this *Iot) InvalidateService(id string) {
+	this.cache.Del("service." + id)
+}
+
 func (this *Iot)  GetDeviceInfo(instanceId string, serviceId string, user string) (instance model.DeviceInstance, service model.Service, err error) {
 	token, err := GetUserToken(user)
 	if err != nil {
@@ -23,16 +23,17 @@ import (
 	"github.com/SENERGY-Platform/iot-device-repository/lib/model"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestGetDeviceInfo(t *testing.T) {
-	drcloser, deviceRepoUrl := DeviceRepoMock()
+	drcloser, deviceRepoUrl, _ := DeviceRepoMock()
 	defer drcloser()
-	authcloser, authUrl := AuthMock()
+	authcloser, authUrl, _ := AuthMock()
 	defer authcloser()
-	permcloser, permUrl := PermsearchMock()
+	permcloser, permUrl, _ := PermsearchMock()
 	defer permcloser()
 	util.Config = &util.ConfigStruct{DeviceRepoUrl: deviceRepoUrl, AuthEndpoint:authUrl, PermissionsUrl:permUrl}
 
@@ -48,22 +49,180 @@ func TestGetDeviceInfo(t *testing.T) {
 	}
 }
 
-func DeviceRepoMock()(closer func(), url string){
+func TestGetDeviceInfoCache(t *testing.T) {
+	drcloser, deviceRepoUrl, repoCalls := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, permCalls := PermsearchMock()
+	defer permcloser()
+	util.Config = &util.ConfigStruct{DeviceRepoUrl: deviceRepoUrl, AuthEndpoint:authUrl, PermissionsUrl:permUrl, DeviceCacheExpiration:60, ServiceCacheExpiration:60, PermissionCacheExpiration:60, NegativeCacheExpiration:1}
+
+	iot := NewIot(deviceRepoUrl)
+	for i := 0; i < 3; i++ {
+		device, service, err := iot.GetDeviceInfo("device1", "service1", "user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.Id != "device1" || device.Name != "device1.name" {
+			t.Fatal("unexpected device", device)
+		}
+		if service.Id != "service1" || service.Name != "service1.name" {
+			t.Fatal("unexpected service", service)
+		}
+	}
+	if repoCalls.Get("/devices/device1") != 1 {
+		t.Fatal("unexpected device repository calls", repoCalls.Get("/devices/device1"))
+	}
+	if repoCalls.Get("/services/service1") != 1 {
+		t.Fatal("unexpected device repository calls", repoCalls.Get("/services/service1"))
+	}
+	if permCalls.Get("/jwt/check/deviceinstance/device1/x/bool") != 1 {
+		t.Fatal("unexpected permission search calls", permCalls.Get("/jwt/check/deviceinstance/device1/x/bool"))
+	}
+}
+
+func TestGetDeviceInfoNegativeCache(t *testing.T) {
+	drcloser, deviceRepoUrl, repoCalls := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, permCalls := PermsearchMock()
+	defer permcloser()
+	util.Config = &util.ConfigStruct{DeviceRepoUrl: deviceRepoUrl, AuthEndpoint:authUrl, PermissionsUrl:permUrl, DeviceCacheExpiration:60, ServiceCacheExpiration:60, PermissionCacheExpiration:60, NegativeCacheExpiration:1}
+
+	iot := NewIot(deviceRepoUrl)
+	for i := 0; i < 2; i++ {
+		_, _, err := iot.GetDeviceInfo("unknown", "service1", "user1")
+		if err != ErrResourceNotFound {
+			t.Fatal("expected not found error", err)
+		}
+		_, _, err = iot.GetDeviceInfo("device2", "service1", "user1")
+		if err == nil {
+			t.Fatal("expected access error")
+		}
+	}
+	if repoCalls.Get("/devices/unknown") != 1 {
+		t.Fatal("unexpected device repository calls", repoCalls.Get("/devices/unknown"))
+	}
+	if permCalls.Get("/jwt/check/deviceinstance/device2/x/bool") != 1 {
+		t.Fatal("unexpected permission search calls", permCalls.Get("/jwt/check/deviceinstance/device2/x/bool"))
+	}
+
+	time.Sleep(2 * time.Second)
+
+	_, _, err := iot.GetDeviceInfo("unknown", "service1", "user1")
+	if err != ErrResourceNotFound {
+		t.Fatal("expected not found error", err)
+	}
+	_, _, err = iot.GetDeviceInfo("device2", "service1", "user1")
+	if err == nil {
+		t.Fatal("expected access error")
+	}
+	if repoCalls.Get("/devices/unknown") != 2 {
+		t.Fatal("negative result should have expired", repoCalls.Get("/devices/unknown"))
+	}
+	if permCalls.Get("/jwt/check/deviceinstance/device2/x/bool") != 2 {
+		t.Fatal("negative result should have expired", permCalls.Get("/jwt/check/deviceinstance/device2/x/bool"))
+	}
+
+	//NegativeCacheExpiration = 0: negative results are not cached
+	util.Config.NegativeCacheExpiration = 0
+	iot = NewIot(deviceRepoUrl)
+	for i := 0; i < 2; i++ {
+		iot.GetDeviceInfo("unknown", "service1", "user1")
+		iot.GetDeviceInfo("device2", "service1", "user1")
+	}
+	if repoCalls.Get("/devices/unknown") != 4 {
+		t.Fatal("negative result cached", repoCalls.Get("/devices/unknown"))
+	}
+	if permCalls.Get("/jwt/check/deviceinstance/device2/x/bool") != 4 {
+		t.Fatal("negative result cached", permCalls.Get("/jwt/check/deviceinstance/device2/x/bool"))
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	drcloser, deviceRepoUrl, repoCalls := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, permCalls := PermsearchMock()
+	defer permcloser()
+	util.Config = &util.ConfigStruct{DeviceRepoUrl: deviceRepoUrl, AuthEndpoint:authUrl, PermissionsUrl:permUrl, DeviceCacheExpiration:60, ServiceCacheExpiration:60, PermissionCacheExpiration:60, NegativeCacheExpiration:60}
+
+	iot := NewIot(deviceRepoUrl)
+	get := func() {
+		_, _, err := iot.GetDeviceInfo("device1", "service1", "user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get()
+	get()
+	HandleDeviceChange(iot, CacheInvalidationMsg{Command: "PUT", Id: "device1"})
+	get()
+	HandleServiceChange(iot, CacheInvalidationMsg{Command: "PUT", Id: "service1"})
+	get()
+	HandlePermissionChange(iot, CacheInvalidationMsg{Command: "PUT", Kind: "deviceinstance", Resource: "device1"})
+	get()
+	HandlePermissionChange(iot, CacheInvalidationMsg{Command: "PUT", Kind: "process", Resource: "device1"})
+	get()
+
+	if repoCalls.Get("/devices/device1") != 2 {
+		t.Fatal("unexpected device repository calls", repoCalls.Get("/devices/device1"))
+	}
+	if repoCalls.Get("/services/service1") != 2 {
+		t.Fatal("unexpected device repository calls", repoCalls.Get("/services/service1"))
+	}
+	if permCalls.Get("/jwt/check/deviceinstance/device1/x/bool") != 3 {
+		t.Fatal("unexpected permission search calls", permCalls.Get("/jwt/check/deviceinstance/device1/x/bool"))
+	}
+}
+
+type MockCalls struct {
+	mux   sync.Mutex
+	calls map[string]int
+}
+
+func NewMockCalls() *MockCalls {
+	return &MockCalls{calls: map[string]int{}}
+}
+
+func (this *MockCalls) Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		this.mux.Lock()
+		this.calls[request.URL.Path] = this.calls[request.URL.Path] + 1
+		this.mux.Unlock()
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+func (this *MockCalls) Get(path string) int {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return this.calls[path]
+}
+
+func DeviceRepoMock()(closer func(), url string, calls *MockCalls){
 	handler := http.NewServeMux()
 	handler.HandleFunc("/devices/device1", func(writer http.ResponseWriter, request *http.Request) {
 		json.NewEncoder(writer).Encode(model.DeviceInstance{Id:"device1", Name:"device1.name", DeviceType:"dt1"})
 	})
+	handler.HandleFunc("/devices/device2", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(model.DeviceInstance{Id:"device2", Name:"device2.name", DeviceType:"dt1"})
+	})
 	handler.HandleFunc("/device-types/dt1", func(writer http.ResponseWriter, request *http.Request) {
 		json.NewEncoder(writer).Encode(model.DeviceType{Id:"dt1", Name:"dt1.name", Services: []model.Service{{Id:"service1", Name:"service1.name"}}})
 	})
 	handler.HandleFunc("/services/service1", func(writer http.ResponseWriter, request *http.Request) {
-		json.NewEncoder(writer).Encode(model.Service{Id:"service1", Name:"service1.name"})
+		json.NewEncoder(writer).Encode(model.Service{Id:"service1", Name:"service1.name", Protocol:model.Protocol{ProtocolHandlerUrl:"protocol1"}})
 	})
-	s := httptest.NewServer(handler)
-	return s.Close, s.URL
+	calls = NewMockCalls()
+	s := httptest.NewServer(calls.Handler(handler))
+	return s.Close, s.URL, calls
 }
 
-func AuthMock()(closer func(), url string){
+func AuthMock()(closer func(), url string, calls *MockCalls){
 	handler := http.NewServeMux()
 	handler.HandleFunc("/auth/realms/master/protocol/openid-connect/token", func(writer http.ResponseWriter, request *http.Request) {
 		json.NewEncoder(writer).Encode(OpenidToken{ExpiresIn:1000000000000, RefreshExpiresIn:100000000000, TokenType:"Bearer", RequestTime:time.Now(), AccessToken:"eyJhbGciOiJSUzI1NiIsInR5cCIgOiAiSldUIiwia2lkIiA6ICIzaUtabW9aUHpsMmRtQnBJdS1vSkY4ZVVUZHh4OUFIckVOcG5CcHM5SjYwIn0.eyJqdGkiOiJiOGUyNGZkNy1jNjJlLTRhNWQtOTQ4ZC1mZGI2ZWVkM2JmYzYiLCJleHAiOjE1MzA1MzIwMzIsIm5iZiI6MCwiaWF0IjoxNTMwNTI4NDMyLCJpc3MiOiJodHRwczovL2F1dGguc2VwbC5pbmZhaS5vcmcvYXV0aC9yZWFsbXMvbWFzdGVyIiwiYXVkIjoiZnJvbnRlbmQiLCJzdWIiOiJkZDY5ZWEwZC1mNTUzLTQzMzYtODBmMy03ZjQ1NjdmODVjN2IiLCJ0eXAiOiJCZWFyZXIiLCJhenAiOiJmcm9udGVuZCIsIm5vbmNlIjoiMjJlMGVjZjgtZjhhMS00NDQ1LWFmMjctNGQ1M2JmNWQxOGI5IiwiYXV0aF90aW1lIjoxNTMwNTI4NDIzLCJzZXNzaW9uX3N0YXRlIjoiMWQ3NWE5ODQtNzM1OS00MWJlLTgxYjktNzMyZDgyNzRjMjNlIiwiYWNyIjoiMCIsImFsbG93ZWQtb3JpZ2lucyI6WyIqIl0sInJlYWxtX2FjY2VzcyI6eyJyb2xlcyI6WyJjcmVhdGUtcmVhbG0iLCJhZG1pbiIsImRldmVsb3BlciIsInVtYV9hdXRob3JpemF0aW9uIiwidXNlciJdfSwicmVzb3VyY2VfYWNjZXNzIjp7Im1hc3Rlci1yZWFsbSI6eyJyb2xlcyI6WyJ2aWV3LWlkZW50aXR5LXByb3ZpZGVycyIsInZpZXctcmVhbG0iLCJtYW5hZ2UtaWRlbnRpdHktcHJvdmlkZXJzIiwiaW1wZXJzb25hdGlvbiIsImNyZWF0ZS1jbGllbnQiLCJtYW5hZ2UtdXNlcnMiLCJxdWVyeS1yZWFsbXMiLCJ2aWV3LWF1dGhvcml6YXRpb24iLCJxdWVyeS1jbGllbnRzIiwicXVlcnktdXNlcnMiLCJtYW5hZ2UtZXZlbnRzIiwibWFuYWdlLXJlYWxtIiwidmlldy1ldmVudHMiLCJ2aWV3LXVzZXJzIiwidmlldy1jbGllbnRzIiwibWFuYWdlLWF1dGhvcml6YXRpb24iLCJtYW5hZ2UtY2xpZW50cyIsInF1ZXJ5LWdyb3VwcyJdfSwiYWNjb3VudCI6eyJyb2xlcyI6WyJtYW5hZ2UtYWNjb3VudCIsIm1hbmFnZS1hY2NvdW50LWxpbmtzIiwidmlldy1wcm9maWxlIl19fSwicm9sZXMiOlsidW1hX2F1dGhvcml6YXRpb24iLCJhZG1pbiIsImNyZWF0ZS1yZWFsbSIsImRldmVsb3BlciIsInVzZXIiLCJvZmZsaW5lX2FjY2VzcyJdLCJuYW1lIjoiZGYgZGZmZmYiLCJwcmVmZXJyZWRfdXNlcm5hbWUiOiJzZXBsIiwiZ2l2ZW5fbmFtZSI6ImRmIiwiZmFtaWx5X25hbWUiOiJkZmZmZiIsImVtYWlsIjoic2VwbEBzZXBsLmRlIn0.eOwKV7vwRrWr8GlfCPFSq5WwR_p-_rSJURXCV1K7ClBY5jqKQkCsRL2V4YhkP1uS6ECeSxF7NNOLmElVLeFyAkvgSNOUkiuIWQpMTakNKynyRfH0SrdnPSTwK2V1s1i4VjoYdyZWXKNjeT2tUUX9eCyI5qOf_Dzcai5FhGCSUeKpV0ScUj5lKrn56aamlW9IdmbFJ4VwpQg2Y843Vc0TqpjK9n_uKwuRcQd9jkKHkbwWQ-wyJEbFWXHjQ6LnM84H0CQ2fgBqPPfpQDKjGSUNaCS-jtBcbsBAWQSICwol95BuOAqVFMucx56Wm-OyQOuoQ1jaLt2t-Uxtr-C9wKJWHQ"})
@@ -71,15 +230,23 @@ func AuthMock()(closer func(), url string){
 	handler.HandleFunc("/auth/admin/realms/master/users/user1/role-mappings/realm", func(writer http.ResponseWriter, request *http.Request) {
 		json.NewEncoder(writer).Encode([]RoleMapping{{Name:"admin"}})
 	})
-	s := httptest.NewServer(handler)
-	return s.Close, s.URL
+	calls = NewMockCalls()
+	s := httptest.NewServer(calls.Handler(handler))
+	return s.Close, s.URL, calls
 }
 
-func PermsearchMock()(closer func(), url string){
+func PermsearchMock()(closer func(), url string, calls *MockCalls){
 	handler := http.NewServeMux()
 	handler.HandleFunc("/jwt/check/deviceinstance/device1/x/bool", func(writer http.ResponseWriter, request *http.Request) {
 		json.NewEncoder(writer).Encode(true)
 	})
-	s := httptest.NewServer(handler)
-	return s.Close, s.URL
+	handler.HandleFunc("/jwt/check/deviceinstance/device2/x/bool", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(false)
+	})
+	handler.HandleFunc("/jwt/check/deviceinstance/unknown/x/bool", func(writer http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(writer).Encode(true)
+	})
+	calls = NewMockCalls()
+	s := httptest.NewServer(calls.Handler(handler))
+	return s.Close, s.URL, calls
 }
@@ -18,11 +18,14 @@ package lib
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"net/url"
@@ -34,6 +37,8 @@ import (
 
 type JwtImpersonate string
 
+var ErrResourceNotFound = errors.New("resource not found")
+
 func (this JwtImpersonate) Post(url string, contentType string, body io.Reader) (resp *http.Response, err error) {
 	req, err := http.NewRequest("POST", url, body)
 	if err != nil {
@@ -98,9 +103,35 @@ func (this JwtImpersonate) GetJSON(url string, result interface{}) (err error) {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrResourceNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return errors.New("unexpected statuscode " + strconv.Itoa(resp.StatusCode) + " on GET " + url)
+	}
 	return json.NewDecoder(resp.Body).Decode(result)
 }
 
+//returns the unverified "sub" claim of the token or the whole token if it can not be parsed
+func (this JwtImpersonate) Subject() string {
+	parts := strings.Split(strings.TrimPrefix(string(this), "Bearer "), ".")
+	if len(parts) < 2 {
+		return string(this)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return string(this)
+	}
+	claims := struct {
+		Subject string `json:"sub"`
+	}{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil || claims.Subject == "" {
+		return string(this)
+	}
+	return claims.Subject
+}
+
 type OpenidToken struct {
 	AccessToken      string    `json:"access_token"`
 	ExpiresIn        float64   `json:"expires_in"`
@@ -146,6 +177,7 @@ func EnsureAccess() (token JwtImpersonate, err error) {
 
 func getOpenidToken(token *OpenidToken) (err error) {
 	requesttime := time.Now()
+	defer observeDependency(DependencyKeycloak, requesttime)
 	resp, err := http.PostForm(util.Config.AuthEndpoint+"/auth/realms/master/protocol/openid-connect/token", url.Values{
 		"client_id":     {util.Config.AuthClientId},
 		"client_secret": {util.Config.AuthClientSecret},
@@ -170,6 +202,7 @@ func getOpenidToken(token *OpenidToken) (err error) {
 
 func refreshOpenidToken(token *OpenidToken) (err error) {
 	requesttime := time.Now()
+	defer observeDependency(DependencyKeycloak, requesttime)
 	resp, err := http.PostForm(util.Config.AuthEndpoint+"/auth/realms/master/protocol/openid-connect/token", url.Values{
 		"client_id":     {util.Config.AuthClientId},
 		"client_secret": {util.Config.AuthClientSecret},
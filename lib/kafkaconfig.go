@@ -0,0 +1,130 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+var kafkaCompressionCodecs = map[string]sarama.CompressionCodec{
+	"":       sarama.CompressionNone,
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+var kafkaRequiredAcks = map[string]sarama.RequiredAcks{
+	"":      sarama.WaitForLocal,
+	"none":  sarama.NoResponse,
+	"local": sarama.WaitForLocal,
+	"all":   sarama.WaitForAll,
+}
+
+//KafkaVersion if set; otherwise fallback
+func getKafkaVersion(fallback sarama.KafkaVersion) (sarama.KafkaVersion, error) {
+	if util.Config.KafkaVersion == "" {
+		return fallback, nil
+	}
+	return sarama.ParseKafkaVersion(util.Config.KafkaVersion)
+}
+
+//producer config from KafkaVersion, KafkaCompression, KafkaRequiredAcks, KafkaIdempotent, KafkaMaxMessageBytes and KafkaFlush*
+func NewKafkaProducerConfig() (config *sarama.Config, err error) {
+	config = sarama.NewConfig()
+	config.Version, err = getKafkaVersion(sarama.V0_10_0_1)
+	if err != nil {
+		return config, err
+	}
+	compression, ok := kafkaCompressionCodecs[util.Config.KafkaCompression]
+	if !ok {
+		return config, errors.New("unknown KafkaCompression " + util.Config.KafkaCompression)
+	}
+	if compression == sarama.CompressionZSTD && !config.Version.IsAtLeast(sarama.V2_1_0_0) {
+		return config, errors.New("zstd compression requires KafkaVersion >= 2.1.0")
+	}
+	config.Producer.Compression = compression
+	acks, ok := kafkaRequiredAcks[util.Config.KafkaRequiredAcks]
+	if !ok {
+		return config, errors.New("unknown KafkaRequiredAcks " + util.Config.KafkaRequiredAcks)
+	}
+	config.Producer.RequiredAcks = acks
+	if util.Config.KafkaIdempotent == "true" {
+		if acks != sarama.WaitForAll {
+			return config, errors.New("KafkaIdempotent requires KafkaRequiredAcks = all")
+		}
+		config.Producer.Idempotent = true
+		config.Net.MaxOpenRequests = 1
+	}
+	if util.Config.KafkaMaxMessageBytes > 0 {
+		config.Producer.MaxMessageBytes = int(util.Config.KafkaMaxMessageBytes)
+	}
+	config.Producer.Flush.Frequency = time.Duration(util.Config.KafkaFlushFrequency) * time.Millisecond
+	config.Producer.Flush.Messages = int(util.Config.KafkaFlushMessages)
+	config.Producer.Return.Successes = true
+	err = SetKafkaSecurity(config)
+	if err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+//sarama refuses messages with headers for KafkaVersion < 0.11
+func kafkaHeadersSupported() bool {
+	version, err := getKafkaVersion(sarama.V0_10_0_1)
+	return err == nil && version.IsAtLeast(sarama.V0_11_0_0)
+}
+
+//consumer config with KafkaVersion, which has to be at least minVersion
+func NewKafkaConsumerConfig(minVersion sarama.KafkaVersion) (config *sarama.Config, err error) {
+	config = sarama.NewConfig()
+	config.Version, err = getKafkaVersion(minVersion)
+	if err != nil {
+		return config, err
+	}
+	if !config.Version.IsAtLeast(minVersion) {
+		return config, errors.New("KafkaVersion has to be at least " + minVersion.String())
+	}
+	err = SetKafkaSecurity(config)
+	return config, err
+}
+
+//checks the kafka settings on startup
+func ValidateKafkaConfig() (err error) {
+	_, err = NewKafkaProducerConfig()
+	if err != nil {
+		return err
+	}
+	if !kafkaHeadersSupported() {
+		log.Println("WARNING: KafkaVersion < 0.11.0; commands are sent without headers")
+	}
+	switch util.Config.KafkaMessageKey {
+	case "", MessageKeyDevice, MessageKeyService, MessageKeyNone:
+	default:
+		return errors.New("unknown KafkaMessageKey " + util.Config.KafkaMessageKey)
+	}
+	if util.Config.KafkaBootstrap != "" {
+		_, err = NewKafkaConsumerConfig(sarama.V0_10_2_0)
+	}
+	return err
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+func TestValidateKafkaConfig(t *testing.T) {
+	valid := []util.ConfigStruct{
+		{},
+		{KafkaVersion: "2.1.0", KafkaCompression: "zstd", KafkaRequiredAcks: "all", KafkaIdempotent: "true"},
+		{KafkaVersion: "1.0.0", KafkaCompression: "lz4", KafkaRequiredAcks: "none", KafkaMaxMessageBytes: 2000000, KafkaFlushFrequency: 500, KafkaFlushMessages: 100},
+		{KafkaBootstrap: "localhost:9092", KafkaVersion: "0.10.2.0"},
+	}
+	for _, config := range valid {
+		util.Config = &config
+		if err := ValidateKafkaConfig(); err != nil {
+			t.Fatal(config, err)
+		}
+	}
+	invalid := []util.ConfigStruct{
+		{KafkaVersion: "foo"},
+		{KafkaCompression: "foo"},
+		{KafkaRequiredAcks: "foo"},
+		{KafkaVersion: "1.0.0", KafkaCompression: "zstd"},
+		{KafkaVersion: "2.1.0", KafkaIdempotent: "true"},
+		{KafkaVersion: "2.1.0", KafkaRequiredAcks: "local", KafkaIdempotent: "true"},
+		{KafkaRequiredAcks: "all", KafkaIdempotent: "true"}, //default version is too old
+		{KafkaBootstrap: "localhost:9092", KafkaVersion: "0.10.1.0"},
+	}
+	for _, config := range invalid {
+		util.Config = &config
+		if err := ValidateKafkaConfig(); err == nil {
+			t.Fatal("expected error", config)
+		}
+	}
+
+	util.Config = &util.ConfigStruct{KafkaVersion: "2.1.0", KafkaCompression: "gzip", KafkaRequiredAcks: "all", KafkaIdempotent: "true", KafkaFlushFrequency: 500}
+	config, err := NewKafkaProducerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Version != sarama.V2_1_0_0 || config.Producer.Compression != sarama.CompressionGZIP || config.Producer.RequiredAcks != sarama.WaitForAll || !config.Producer.Idempotent || config.Producer.Flush.Frequency != 500*time.Millisecond {
+		t.Fatal(config)
+	}
+}
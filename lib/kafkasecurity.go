@@ -0,0 +1,91 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/sha512"
+	"crypto/tls"
+	"errors"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+//applies the KafkaTls* and KafkaSasl* settings; used for the producer and all consumers
+func SetKafkaSecurity(config *sarama.Config) (err error) {
+	if KafkaTlsEnabled() {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config, err = getKafkaTlsConfig()
+		if err != nil {
+			return err
+		}
+	}
+	mechanism := sarama.SASLMechanism(util.Config.KafkaSaslMechanism)
+	switch mechanism {
+	case "":
+		return nil
+	case sarama.SASLTypePlaintext:
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.SHA256}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{hash: scram.HashGeneratorFcn(sha512.New)}
+		}
+	default:
+		return errors.New("unknown KafkaSaslMechanism " + util.Config.KafkaSaslMechanism)
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Mechanism = mechanism
+	config.Net.SASL.User = util.Config.KafkaSaslUser
+	config.Net.SASL.Password = util.Config.KafkaSaslPassword
+	return nil
+}
+
+func KafkaTlsEnabled() bool {
+	return util.Config.KafkaTls == "true" || util.Config.KafkaTlsCaFile != "" || util.Config.KafkaTlsCertFile != ""
+}
+
+func getKafkaTlsConfig() (result *tls.Config, err error) {
+	return newTlsConfig(util.Config.KafkaTlsCaFile, util.Config.KafkaTlsCertFile, util.Config.KafkaTlsKeyFile, util.Config.KafkaTlsSkipVerify == "true")
+}
+
+//sarama.SCRAMClient; a new instance is generated for every broker connection
+type scramClient struct {
+	hash         scram.HashGeneratorFcn
+	conversation *scram.ClientConversation
+}
+
+func (this *scramClient) Begin(userName, password, authzID string) error {
+	client, err := this.hash.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	this.conversation = client.NewConversation()
+	return nil
+}
+
+func (this *scramClient) Step(challenge string) (string, error) {
+	return this.conversation.Step(challenge)
+}
+
+func (this *scramClient) Done() bool {
+	return this.conversation.Done()
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+	"github.com/xdg/scram"
+)
+
+func TestKafkaTls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkatls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	ca, caKey := testCertificate(t, caTemplate, nil, nil)
+	serverCert, serverKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	clientCert, clientKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "worker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	caFile := writeTestPem(t, dir, "ca.pem", "CERTIFICATE", ca.Raw)
+	certFile := writeTestPem(t, dir, "cert.pem", "CERTIFICATE", clientCert.Raw)
+	keyBytes, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := writeTestPem(t, dir, "key.pem", "EC PRIVATE KEY", keyBytes)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := sarama.NewMockBrokerListener(t, 1, listener)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID()),
+	})
+
+	util.Config = &util.ConfigStruct{
+		KafkaBootstrap:   broker.Addr(),
+		KafkaTlsCaFile:   caFile,
+		KafkaTlsCertFile: certFile,
+		KafkaTlsKeyFile:  keyFile,
+	}
+	producer, err := InitProducer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	producer.Close()
+
+	//a listener that only does the tls handshake; clients without certificate must be rejected
+	plainListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plainListener.Close()
+	go func() {
+		for {
+			conn, err := plainListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	util.Config = &util.ConfigStruct{KafkaTlsCaFile: caFile}
+	conf := sarama.NewConfig()
+	conf.Metadata.Retry.Max = 0
+	err = SetKafkaSecurity(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := sarama.NewClient([]string{plainListener.Addr().String()}, conf)
+	if err == nil {
+		client.Close()
+		t.Fatal("expected rejected connection without client certificate")
+	}
+}
+
+func TestKafkaSasl(t *testing.T) {
+	for _, mechanism := range []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		util.Config = &util.ConfigStruct{KafkaSaslMechanism: mechanism, KafkaSaslUser: "user", KafkaSaslPassword: "pw"}
+		conf := sarama.NewConfig()
+		conf.Version = sarama.V1_0_0_0
+		err := SetKafkaSecurity(conf)
+		if err != nil {
+			t.Fatal(mechanism, err)
+		}
+		if err = conf.Validate(); err != nil {
+			t.Fatal(mechanism, err)
+		}
+	}
+	util.Config = &util.ConfigStruct{KafkaSaslMechanism: "foo"}
+	if SetKafkaSecurity(sarama.NewConfig()) == nil {
+		t.Fatal("expected error for unknown mechanism")
+	}
+
+	util.Config = &util.ConfigStruct{KafkaSaslMechanism: "SCRAM-SHA-256", KafkaSaslUser: "user", KafkaSaslPassword: "pw"}
+	conf := sarama.NewConfig()
+	SetKafkaSecurity(conf)
+	client := conf.Net.SASL.SCRAMClientGeneratorFunc()
+	credentialClient, _ := scram.SHA256.NewClient("user", "pw", "")
+	credentials := credentialClient.GetStoredCredentials(scram.KeyFactors{Salt: "salt", Iters: 4096})
+	server, _ := scram.SHA256.NewServer(func(string) (scram.StoredCredentials, error) {
+		return credentials, nil
+	})
+	serverConversation := server.NewConversation()
+	err := client.Begin("user", "pw", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := ""
+	for !client.Done() {
+		response, err := client.Step(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.Done() {
+			break
+		}
+		challenge, err = serverConversation.Step(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !serverConversation.Valid() {
+		t.Fatal("invalid scram conversation")
+	}
+}
+
+func testCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func writeTestPem(t *testing.T, dir string, name string, blockType string, content []byte) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: content}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+//values of util.Config.FatalKafkaErrors
+const (
+	KafkaErrorsFatal     = "fatal"
+	KafkaErrorsReconnect = "reconnect"
+	KafkaErrorsIgnore    = "ignore"
+)
+
+//"true" and "false" are the values of the former boolean setting
+func GetKafkaErrorPolicy() string {
+	switch util.Config.FatalKafkaErrors {
+	case "true", KafkaErrorsFatal:
+		return KafkaErrorsFatal
+	case "false", KafkaErrorsIgnore:
+		return KafkaErrorsIgnore
+	default:
+		return KafkaErrorsReconnect
+	}
+}
+
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+	current time.Duration
+}
+
+func NewKafkaReconnectBackoff() *Backoff {
+	initial := time.Duration(util.Config.KafkaReconnectBackoff) * time.Millisecond
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := time.Duration(util.Config.KafkaReconnectMaxBackoff) * time.Millisecond
+	if max < initial {
+		max = initial
+	}
+	return &Backoff{Initial: initial, Max: max}
+}
+
+//returns the next wait duration; doubled on every call up to Max
+func (this *Backoff) Next() time.Duration {
+	if this.current == 0 {
+		this.current = this.Initial
+	} else {
+		this.current = this.current * 2
+	}
+	if this.current > this.Max {
+		this.current = this.Max
+	}
+	return this.current
+}
+
+func (this *Backoff) Reset() {
+	this.current = 0
+}
@@ -0,0 +1,55 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+)
+
+//default transport; commands are produced to the protocol topics, responses are consumed from ResponseTopic
+type KafkaTransport struct{}
+
+func (this KafkaTransport) Publish(taskId string, command CommandMessage) error {
+	if taskId == "" {
+		return ProduceSync(command.Topic, command.Value)
+	}
+	return ProduceCommand(taskId, command)
+}
+
+func (this KafkaTransport) Subscribe(ctx context.Context, handler ResponseHandler) {
+	InitConsumer(ctx, handler)
+}
+
+//producer and consumer report their state themselves
+func (this KafkaTransport) Health() error {
+	checks := GetHealthReport().Checks
+	for _, name := range []string{HealthKafkaProducer, HealthKafkaConsumer} {
+		check, ok := checks[name]
+		if !ok {
+			return errors.New(name + " not connected")
+		}
+		if !check.Ok {
+			return errors.New(name + ": " + check.Error)
+		}
+	}
+	return nil
+}
+
+func (this KafkaTransport) Close() {
+	CloseProducer()
+}
@@ -41,6 +41,7 @@ func getUserRoles(user string) (roles []string, err error) {
 		return roles, err
 	}
 	roleMappings := []RoleMapping{}
+	defer observeDependency(DependencyKeycloak, time.Now())
 	err = clientToken.GetJSON(util.Config.AuthEndpoint+"/auth/admin/realms/master/users/"+user+"/role-mappings/realm", &roleMappings)
 	if err != nil {
 		log.Println("ERROR: getUserRoles::GetJSON()", err, util.Config.AuthEndpoint+"/auth/admin/realms/master/users/"+user+"/role-mappings/realm", string(clientToken))
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+)
+
+//answers a command like a protocol handler; ok = false sends no response
+type MemoryResponder func(command CommandMessage) (response string, ok bool)
+
+//transport without broker for tests and local development; Respond() or the Responder play the protocol handler
+type MemoryTransport struct {
+	Responder MemoryResponder
+	mux       sync.Mutex
+	published []CommandMessage
+	responses chan Response
+	offset    int64
+}
+
+func NewMemoryTransport(responder MemoryResponder) *MemoryTransport {
+	return &MemoryTransport{Responder: responder, responses: make(chan Response, 1000)}
+}
+
+func (this *MemoryTransport) Publish(taskId string, command CommandMessage) error {
+	this.mux.Lock()
+	this.published = append(this.published, command)
+	this.mux.Unlock()
+	if taskId != "" && this.Responder != nil {
+		if response, ok := this.Responder(command); ok {
+			this.Respond(response)
+		}
+	}
+	return nil
+}
+
+//queues a response for Subscribe
+func (this *MemoryTransport) Respond(response string) {
+	this.mux.Lock()
+	offset := this.offset
+	this.offset++
+	this.mux.Unlock()
+	this.responses <- Response{Value: response, Topic: "memory", Offset: offset}
+}
+
+//responses which are not done are delivered again after a second
+func (this *MemoryTransport) Subscribe(ctx context.Context, handler ResponseHandler) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case response := <-this.responses:
+			for handler(response) != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+			}
+		}
+	}
+}
+
+//messages published so far
+func (this *MemoryTransport) Published() []CommandMessage {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	return append([]CommandMessage{}, this.published...)
+}
+
+func (this *MemoryTransport) Health() error {
+	return nil
+}
+
+func (this *MemoryTransport) Close() {}
+
+//responds to every command without protocol parts, as a protocol handler of a service without outputs would do
+func EchoResponder(command CommandMessage) (response string, ok bool) {
+	envelope := struct {
+		Value messages.ProtocolMsg `json:"value"`
+	}{}
+	err := json.Unmarshal([]byte(command.Value), &envelope)
+	if err != nil {
+		return "", false
+	}
+	envelope.Value.ProtocolParts = nil
+	msg, err := json.Marshal(envelope.Value)
+	return string(msg), err == nil
+}
@@ -16,6 +16,8 @@
 
 package messages
 
+import "time"
+
 type CamundaVariable struct {
 	Type  string      `json:"type,omitempty"`
 	Value interface{} `json:"value,omitempty"`
@@ -29,25 +31,30 @@ type CamundaOutput struct {
 //https://github.com/camunda/camunda-docs-manual/blob/master/content/reference/rest/external-task/fetch.md
 type CamundaTask struct {
 	Id                  string                     `json:"id,omitempty"`
+	TopicName           string                     `json:"topicName,omitempty"`
 	Variables           map[string]CamundaVariable `json:"variables,omitempty"`
 	ActivityId          string                     `json:"activityId,omitempty"`
-	Retries             int64                      `json:"retries"`
+	Retries             *int64                     `json:"retries"` //null until the first failure
 	ExecutionId         string                     `json:"executionId"`
 	ProcessInstanceId   string                     `json:"processInstanceId"`
 	ProcessDefinitionId string                     `json:"processDefinitionId"`
 	TenantId            string                     `json:"tenantId"`
+	WorkerId            string                     `json:"workerId,omitempty"` //owner of the lock; set by GET /external-task/{id}
+	LockTime            time.Time                  `json:"-"`                  //fetch time; the lock expires after the lock duration of the topic
 	Error				string					   `json:"errorMessage"`
 }
 
 type CamundaTopic struct {
-	Name         string `json:"topicName,omitempty"`
-	LockDuration int64  `json:"lockDuration,omitempty"`
+	Name         string   `json:"topicName,omitempty"`
+	LockDuration int64    `json:"lockDuration,omitempty"`
+	Variables    []string `json:"variables,omitempty"`
 }
 
 type CamundaFetchRequest struct {
-	WorkerId string         `json:"workerId,omitempty"`
-	MaxTasks int64          `json:"maxTasks,omitempty"`
-	Topics   []CamundaTopic `json:"topics,omitempty"`
+	WorkerId             string         `json:"workerId,omitempty"`
+	MaxTasks             int64          `json:"maxTasks,omitempty"`
+	AsyncResponseTimeout int64          `json:"asyncResponseTimeout,omitempty"` //long polling in ms; supported since camunda 7.8
+	Topics               []CamundaTopic `json:"topics,omitempty"`
 }
 
 //https://github.com/camunda/camunda-docs-manual/blob/master/content/reference/rest/external-task/post-complete.md
@@ -65,4 +72,19 @@ type CamundaError struct {
 	ErrorMessage string `json:"errorMessage"`
 	ErrorDetails string `json:"errorDetails"`
 	Retries      int64  `json:"retries"`
+	RetryTimeout int64  `json:"retryTimeout"`
+}
+
+//https://github.com/camunda/camunda-docs-manual/blob/master/content/reference/rest/external-task/post-bpmn-error.md
+type CamundaBpmnError struct {
+	WorkerId     string                   `json:"workerId"`
+	ErrorCode    string                   `json:"errorCode"`
+	ErrorMessage string                   `json:"errorMessage,omitempty"`
+	Variables    map[string]CamundaOutput `json:"variables,omitempty"`
+}
+
+//https://github.com/camunda/camunda-docs-manual/blob/master/content/reference/rest/external-task/post-extend-lock.md
+type CamundaExtendLockRequest struct {
+	WorkerId    string `json:"workerId"`
+	NewDuration int64  `json:"newDuration"`
 }
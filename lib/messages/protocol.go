@@ -34,4 +34,5 @@ type ProtocolMsg struct {
 	OutputName       string         `json:"output_name"`
 	Time             string         `json:"time"`
 	Service          model.Service  `json:"service"`
+	Error            string         `json:"error,omitempty"` //set by the protocol handler if the device could not execute the command
 }
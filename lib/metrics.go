@@ -0,0 +1,126 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "external_task_worker"
+
+//dependency label values of DependencyDuration
+const (
+	DependencyDeviceRepository = "device_repository"
+	DependencyPermissionSearch = "permission_search"
+	DependencyKeycloak         = "keycloak"
+	DependencyProtocolHandler  = "protocol_handler" //http protocol handlers
+)
+
+var (
+	TasksFetched = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_fetched_total",
+		Help:      "camunda tasks fetched by topic",
+	}, []string{"topic"})
+	TasksExecuted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_executed_total",
+		Help:      "camunda tasks passed to their topic handler",
+	}, []string{"topic"})
+	TasksCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_completed_total",
+		Help:      "camunda tasks completed by topic",
+	}, []string{"topic"})
+	TasksFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_failed_total",
+		Help:      "camunda tasks reported as failure or bpmn error by topic and error class",
+	}, []string{"topic", "error_class"})
+	FetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "camunda_fetch_duration_seconds",
+		Help:      "duration of fetchAndLock requests including long polling",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60},
+	})
+	DependencyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "dependency_request_duration_seconds",
+		Help:      "duration of requests to the device repository, permission search, keycloak and http protocol handlers",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"dependency"})
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "device, service and permission cache lookups by result (hit, miss)",
+	}, []string{"result"})
+	KafkaProduced = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "kafka_produced_total",
+		Help:      "kafka messages by result (success, error, retry)",
+	}, []string{"result"})
+	ResponseRoundTrip = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_round_trip_seconds",
+		Help:      "time between sending a device command and completing its camunda task",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"topic"})
+	DeadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letters_total",
+		Help:      "responses published to the dead letter topic",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(TasksFetched, TasksExecuted, TasksCompleted, TasksFailed, FetchDuration, DependencyDuration, CacheRequests, KafkaProduced, ResponseRoundTrip, DeadLetters)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tasks_in_flight",
+		Help:      "sent device commands waiting for their response",
+	}, func() float64 {
+		return float64(GetInFlightRegistry().Len())
+	}))
+	for result, get := range map[string]func(stats InFlightStats) uint64{
+		"accepted":        func(stats InFlightStats) uint64 { return stats.Accepted },
+		"unknown":         func(stats InFlightStats) uint64 { return stats.Unknown },
+		"duplicate":       func(stats InFlightStats) uint64 { return stats.Duplicate },
+		"foreign":         func(stats InFlightStats) uint64 { return stats.Foreign },
+		"foreign_dropped": func(stats InFlightStats) uint64 { return stats.ForeignDropped },
+		"expired":         func(stats InFlightStats) uint64 { return stats.Expired },
+	} {
+		get := get
+		prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "responses_total",
+			Help:        "responses by correlation result; expired counts tasks without response",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 {
+			return float64(get(GetInFlightRegistry().Stats()))
+		}))
+	}
+}
+
+func observeDependency(dependency string, start time.Time) {
+	DependencyDuration.WithLabelValues(dependency).Observe(time.Since(start).Seconds())
+}
+
+func countTaskFailure(topic string, class string) {
+	TasksFailed.WithLabelValues(topic, class).Inc()
+}
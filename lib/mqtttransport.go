@@ -0,0 +1,232 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+var mqttPublishTimeout = 10 * time.Second
+
+//commands are published to <MqttCommandPrefix>/<protocol topic>, responses are received from MqttResponseTopic
+//responses are handled concurrently and acknowledged when they are done; their order is not preserved
+type MqttTransport struct {
+	client        paho.Client
+	qos           byte
+	commandPrefix string
+	responseTopic string
+	backoff       Backoff //template; copied for every retry loop
+	mux           sync.Mutex
+	ctx           context.Context
+	handler       ResponseHandler
+	subscribed    chan bool
+	closed        chan bool
+	once          sync.Once
+}
+
+//connects in the background; paho reconnects after the first successful connection
+func NewMqttTransport() (result *MqttTransport, err error) {
+	if util.Config.MqttQos < 0 || util.Config.MqttQos > 2 {
+		return result, errors.New("MqttQos has to be 0, 1 or 2")
+	}
+	if util.Config.MqttResponseTopic == "" {
+		return result, errors.New("missing MqttResponseTopic")
+	}
+	cleanSession := util.Config.MqttCleanSession == "true"
+	clientId := util.Config.MqttClientId
+	if clientId == "" {
+		clientId = util.Config.WorkerId
+	}
+	if clientId == "" && !cleanSession {
+		//the broker identifies the persistent session by the client id; a random id would orphan the queued responses on every restart
+		return result, errors.New("persistent mqtt sessions require MqttClientId or WorkerId")
+	}
+	if clientId == "" {
+		clientId = GetWorkerId()
+	}
+	result = &MqttTransport{
+		qos:           byte(util.Config.MqttQos),
+		commandPrefix: strings.TrimSuffix(util.Config.MqttCommandPrefix, "/"),
+		responseTopic: util.Config.MqttResponseTopic,
+		backoff:       *NewKafkaReconnectBackoff(),
+		subscribed:    make(chan bool),
+		closed:        make(chan bool),
+	}
+	options := paho.NewClientOptions().
+		AddBroker(util.Config.MqttBroker).
+		SetClientID(clientId).
+		SetUsername(util.Config.MqttUser).
+		SetPassword(util.Config.MqttPassword).
+		SetCleanSession(cleanSession).
+		SetAutoReconnect(true).
+		SetOrderMatters(false). //a response that is not done may not block later responses and the keepalive of paho's router
+		SetOnConnectHandler(result.onConnect).
+		SetDefaultPublishHandler(result.onResponse). //queued responses of a persistent session may arrive before the subscription
+
+		SetConnectionLostHandler(func(client paho.Client, err error) {
+			log.Println("ERROR: lost mqtt connection", err)
+			ReportHealth(HealthMqtt, true, err)
+		})
+	if util.Config.MqttTlsCaFile != "" || util.Config.MqttTlsCertFile != "" {
+		tlsConfig, err := newTlsConfig(util.Config.MqttTlsCaFile, util.Config.MqttTlsCertFile, util.Config.MqttTlsKeyFile, false)
+		if err != nil {
+			return result, err
+		}
+		options.SetTLSConfig(tlsConfig)
+	}
+	result.client = paho.NewClient(options)
+	go result.connect()
+	return result, nil
+}
+
+func (this *MqttTransport) connect() {
+	backoff := this.backoff
+	for {
+		token := this.client.Connect()
+		token.Wait()
+		if token.Error() == nil {
+			return
+		}
+		select {
+		case <-this.closed:
+			return
+		default:
+		}
+		log.Println("ERROR: unable to connect to mqtt broker", token.Error())
+		ReportHealth(HealthMqtt, true, token.Error())
+		select {
+		case <-this.closed:
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+//(re)subscribes; with persistent sessions the broker keeps the subscription and queues responses while the worker is offline
+func (this *MqttTransport) onConnect(client paho.Client) {
+	ReportHealth(HealthMqtt, true, nil)
+	this.mux.Lock()
+	subscribed := this.handler != nil
+	this.mux.Unlock()
+	if subscribed {
+		this.subscribe()
+	}
+}
+
+//retried with backoff until the broker accepts the subscription; after a lost connection onConnect subscribes again
+func (this *MqttTransport) subscribe() {
+	go func() {
+		backoff := this.backoff
+		for {
+			token := this.client.Subscribe(this.responseTopic, this.qos, this.onResponse)
+			//Wait() returns when paho completes or cancels the token; WaitTimeout() would delay a concurrent Disconnect()
+			token.Wait()
+			err := token.Error()
+			if err == nil {
+				if suback, ok := token.(*paho.SubscribeToken); ok && suback.Result()[this.responseTopic] == 0x80 {
+					err = errors.New("subscription rejected by broker")
+				}
+			}
+			select {
+			case <-this.closed:
+				return
+			default:
+			}
+			if err == nil {
+				return
+			}
+			log.Println("ERROR: unable to subscribe to", this.responseTopic, err)
+			ReportHealth(HealthMqtt, true, err)
+			select {
+			case <-this.closed:
+				return
+			case <-time.After(backoff.Next()):
+			}
+			if !this.client.IsConnectionOpen() {
+				return
+			}
+		}
+	}()
+}
+
+//runs in its own goroutine (SetOrderMatters(false)); paho acknowledges the message when this function returns
+//a response that is not done is retried until ctx is done
+func (this *MqttTransport) onResponse(client paho.Client, msg paho.Message) {
+	select {
+	case <-this.subscribed:
+	case <-this.closed:
+		return
+	}
+	this.mux.Lock()
+	ctx, handler := this.ctx, this.handler
+	this.mux.Unlock()
+	response := Response{Value: string(msg.Payload()), Topic: msg.Topic(), Offset: int64(msg.MessageID())}
+	backoff := this.backoff
+	for handler(response) != nil {
+		select {
+		case <-ctx.Done():
+			//no ack: the broker delivers the response again after the next connect
+			client.Disconnect(0)
+			return
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
+func (this *MqttTransport) Publish(taskId string, command CommandMessage) error {
+	topic := command.Topic
+	if taskId != "" {
+		topic = this.commandPrefix + "/" + command.Topic
+	}
+	token := this.client.Publish(topic, this.qos, false, command.Value)
+	if !token.WaitTimeout(mqttPublishTimeout) {
+		return errors.New("mqtt publish timeout")
+	}
+	return token.Error()
+}
+
+func (this *MqttTransport) Subscribe(ctx context.Context, handler ResponseHandler) {
+	this.mux.Lock()
+	this.ctx = ctx
+	this.handler = handler
+	this.mux.Unlock()
+	close(this.subscribed)
+	if this.client.IsConnectionOpen() {
+		this.subscribe()
+	}
+	<-ctx.Done()
+}
+
+func (this *MqttTransport) Health() error {
+	if !this.client.IsConnectionOpen() {
+		return errors.New("mqtt not connected")
+	}
+	return nil
+}
+
+func (this *MqttTransport) Close() {
+	this.once.Do(func() { close(this.closed) })
+	this.client.Disconnect(250)
+}
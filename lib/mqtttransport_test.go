@@ -0,0 +1,420 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func TestMqttTransport(t *testing.T) {
+	broker := startTestMqttBroker(t, nil)
+	defer broker.Close()
+	util.Config = &util.ConfigStruct{
+		Transport:             "mqtt",
+		MqttBroker:            "tcp://" + broker.Addr(),
+		MqttClientId:          "worker",
+		MqttQos:               1,
+		MqttCommandPrefix:     "command",
+		MqttResponseTopic:     "response",
+		KafkaReconnectBackoff: 50,
+	}
+
+	commands := make(chan string, 10)
+	device := paho.NewClient(paho.NewClientOptions().AddBroker(util.Config.MqttBroker).SetClientID("device"))
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+	if token := device.Subscribe("command/protocol1", 1, func(client paho.Client, msg paho.Message) {
+		commands <- string(msg.Payload())
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	err := InitTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker := GetTransport()
+	waitForMqtt(t, worker)
+
+	err = worker.Publish("task1", CommandMessage{Topic: "protocol1", Key: "device1", Value: "command1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case command := <-commands:
+		if command != "command1" {
+			t.Fatal(command)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing command")
+	}
+
+	//the first subscription is rejected and retried
+	//response1 fails once and is retried; response2 is never done and has to be delivered again after a reconnect
+	broker.RejectSubscriptions(1)
+	received := make(chan string, 10)
+	failedMux := sync.Mutex{}
+	failed := map[string]int{}
+	ctx, cancel := context.WithCancel(context.Background())
+	go worker.Subscribe(ctx, func(response Response) error {
+		failedMux.Lock()
+		failed[response.Value]++
+		attempt := failed[response.Value]
+		failedMux.Unlock()
+		if response.Value == "response2" || attempt == 1 {
+			return errors.New("not done")
+		}
+		received <- response.Value
+		return nil
+	})
+	waitForSubscription(t, broker, "worker", "response")
+	device.Publish("response", 1, false, "response1").Wait()
+	select {
+	case response := <-received:
+		failedMux.Lock()
+		attempts := failed["response1"]
+		failedMux.Unlock()
+		if response != "response1" || attempts != 2 {
+			t.Fatal(response, attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing response1")
+	}
+
+	//response2 does not block response3
+	device.Publish("response", 1, false, "response2").Wait()
+	device.Publish("response", 1, false, "response3").Wait()
+	select {
+	case response := <-received:
+		if response != "response3" {
+			t.Fatal(response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response3 blocked by response2")
+	}
+	for i := 0; broker.Inflight("worker") != 1; i++ {
+		if i > 100 {
+			t.Fatal("missing ack of response3")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	worker.Close()
+
+	//persistent session: the broker keeps response2 for the worker
+	err = InitTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker = GetTransport()
+	defer worker.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go worker.Subscribe(ctx, func(response Response) error {
+		received <- response.Value
+		return nil
+	})
+	select {
+	case response := <-received:
+		if response != "response2" {
+			t.Fatal(response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missing response2 after reconnect")
+	}
+}
+
+func TestMqttTransportTls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mqtttls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	serverCert, serverKey := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "broker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	broker := startTestMqttBroker(t, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+	})
+	defer broker.Close()
+
+	util.Config = &util.ConfigStruct{
+		MqttBroker:        "ssl://" + broker.Addr(),
+		MqttClientId:      "worker",
+		MqttResponseTopic: "response",
+		MqttTlsCaFile:     writeTestPem(t, dir, "ca.pem", "CERTIFICATE", ca.Raw),
+	}
+	worker, err := NewMqttTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	waitForMqtt(t, worker)
+
+	//a random client id would orphan the persistent session on every restart
+	util.Config = &util.ConfigStruct{MqttBroker: "tcp://" + broker.Addr(), MqttResponseTopic: "response"}
+	if _, err := NewMqttTransport(); err == nil {
+		t.Fatal("persistent session without client id accepted")
+	}
+	util.Config.MqttCleanSession = "true"
+	worker, err = NewMqttTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.Close()
+}
+
+func waitForMqtt(t *testing.T, transport Transport) {
+	for i := 0; transport.Health() != nil; i++ {
+		if i > 100 {
+			t.Fatal(transport.Health())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func waitForSubscription(t *testing.T, broker *testMqttBroker, clientId string, topic string) {
+	for i := 0; !broker.Subscribed(clientId, topic); i++ {
+		if i > 100 {
+			t.Fatal("missing subscription of", clientId, topic)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+//minimal mqtt 3.1.1 broker: exact topic matches, qos 0 and 1, persistent sessions keep subscriptions and unacknowledged messages
+type testMqttBroker struct {
+	listener net.Listener
+	mux      sync.Mutex
+	sessions map[string]*testMqttSession
+	reject   int //number of subscriptions to reject
+}
+
+type testMqttSession struct {
+	conn     net.Conn
+	subs     map[string]byte
+	inflight []*packets.PublishPacket
+	nextId   uint16
+}
+
+func startTestMqttBroker(t *testing.T, tlsConfig *tls.Config) *testMqttBroker {
+	var listener net.Listener
+	var err error
+	if tlsConfig != nil {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &testMqttBroker{listener: listener, sessions: map[string]*testMqttSession{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.handle(conn)
+		}
+	}()
+	return broker
+}
+
+func (this *testMqttBroker) Addr() string {
+	return this.listener.Addr().String()
+}
+
+func (this *testMqttBroker) Close() {
+	this.listener.Close()
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	for _, session := range this.sessions {
+		if session.conn != nil {
+			session.conn.Close()
+		}
+	}
+}
+
+func (this *testMqttBroker) RejectSubscriptions(count int) {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	this.reject = count
+}
+
+//unacknowledged messages of the session
+func (this *testMqttBroker) Inflight(clientId string) int {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	session, ok := this.sessions[clientId]
+	if !ok {
+		return 0
+	}
+	return len(session.inflight)
+}
+
+func (this *testMqttBroker) Subscribed(clientId string, topic string) bool {
+	this.mux.Lock()
+	defer this.mux.Unlock()
+	session, ok := this.sessions[clientId]
+	if !ok {
+		return false
+	}
+	_, ok = session.subs[topic]
+	return ok
+}
+
+func (this *testMqttBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	this.mux.Lock()
+	session, present := this.sessions[connect.ClientIdentifier]
+	if !present || connect.CleanSession {
+		session = &testMqttSession{subs: map[string]byte{}}
+		this.sessions[connect.ClientIdentifier] = session
+	}
+	session.conn = conn
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.SessionPresent = present && !connect.CleanSession
+	connack.Write(conn)
+	for _, publish := range session.inflight {
+		publish.Dup = true
+		publish.Write(conn)
+	}
+	this.mux.Unlock()
+	defer func() {
+		this.mux.Lock()
+		defer this.mux.Unlock()
+		if session.conn == conn {
+			session.conn = nil
+		}
+		if connect.CleanSession && this.sessions[connect.ClientIdentifier] == session {
+			delete(this.sessions, connect.ClientIdentifier)
+		}
+	}()
+
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		this.mux.Lock()
+		switch p := packet.(type) {
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			if this.reject > 0 {
+				this.reject--
+				for range p.Topics {
+					suback.ReturnCodes = append(suback.ReturnCodes, 0x80)
+				}
+				suback.Write(conn)
+				break
+			}
+			for i, topic := range p.Topics {
+				qos := p.Qoss[i]
+				if qos > 1 {
+					qos = 1
+				}
+				session.subs[topic] = qos
+				suback.ReturnCodes = append(suback.ReturnCodes, qos)
+			}
+			suback.Write(conn)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				puback.Write(conn)
+			}
+			for _, receiver := range this.sessions {
+				if qos, ok := receiver.subs[p.TopicName]; ok {
+					receiver.deliver(p, qos)
+				}
+			}
+		case *packets.PubackPacket:
+			for i, publish := range session.inflight {
+				if publish.MessageID == p.MessageID {
+					session.inflight = append(session.inflight[:i], session.inflight[i+1:]...)
+					break
+				}
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			this.mux.Unlock()
+			return
+		}
+		this.mux.Unlock()
+	}
+}
+
+//has to be called with the lock of the broker
+func (this *testMqttSession) deliver(message *packets.PublishPacket, qos byte) {
+	publish := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	publish.TopicName = message.TopicName
+	publish.Payload = message.Payload
+	publish.Qos = message.Qos
+	if qos < publish.Qos {
+		publish.Qos = qos
+	}
+	if publish.Qos > 0 {
+		this.nextId++
+		publish.MessageID = this.nextId
+		this.inflight = append(this.inflight, publish)
+	}
+	if this.conn != nil {
+		publish.Write(this.conn)
+	}
+}
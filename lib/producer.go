@@ -17,7 +17,9 @@
 package lib
 
 import (
+	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/SENERGY-Platform/external-task-worker/util"
@@ -28,44 +30,251 @@ import (
 	"github.com/wvanbergen/kazoo-go"
 )
 
-var onceProducer sync.Once
+var producerMux sync.Mutex
 var producer sarama.AsyncProducer
+var producerBackoff *Backoff
+var nextProducerAttempt time.Time
 
-func InitProducer() sarama.AsyncProducer {
+//separate from the async producer; a slow acknowledgement must not block commands
+var syncProducerMux sync.Mutex
+var syncProducer sarama.SyncProducer
+var syncProducerBackoff *Backoff
+var nextSyncProducerAttempt time.Time
+
+//returns KafkaBootstrap if set; otherwise the brokers registered in zookeeper
+func GetBrokerList() (broker []string, err error) {
+	if util.Config.KafkaBootstrap != "" {
+		for _, b := range strings.Split(util.Config.KafkaBootstrap, ",") {
+			if b = strings.TrimSpace(b); b != "" {
+				broker = append(broker, b)
+			}
+		}
+		return broker, nil
+	}
 	var kz *kazoo.Kazoo
-	kz, err := kazoo.NewKazooFromConnectionString(util.Config.ZookeeperUrl, nil)
+	kz, err = kazoo.NewKazooFromConnectionString(util.Config.ZookeeperUrl, nil)
+	if err != nil {
+		log.Println("error in kazoo.NewKazooFromConnectionString()", err)
+		return broker, err
+	}
+	defer kz.Close()
+	broker, err = kz.BrokerList()
+	if err != nil {
+		log.Println("error in kz.BrokerList()", err)
+	}
+	return
+}
+
+func InitProducer() (result sarama.AsyncProducer, err error) {
+	broker, err := GetBrokerList()
+	if err != nil {
+		return result, err
+	}
+
+	sarama_conf, err := NewKafkaProducerConfig()
+	if err != nil {
+		return result, err
+	}
+	result, err = sarama.NewAsyncProducer(broker, sarama_conf)
+	if err != nil {
+		log.Println("error in sarama.NewAsyncProducer()", broker, err)
+		return result, err
+	}
+	go func() {
+		for range result.Successes() {
+			KafkaProduced.WithLabelValues("success").Inc()
+			ReportHealth(HealthKafkaProducer, true, nil)
+		}
+	}()
+	go func() {
+		for err := range result.Errors() {
+			handleProducerError(err)
+		}
+	}()
+	return result, nil
+}
+
+//returns the producer; creates it on first use and after failed attempts, limited by the reconnect backoff
+func getProducer() (result sarama.AsyncProducer, err error) {
+	producerMux.Lock()
+	defer producerMux.Unlock()
+	if producer != nil {
+		return producer, nil
+	}
+	if producerBackoff == nil {
+		producerBackoff = NewKafkaReconnectBackoff()
+	}
+	if time.Now().Before(nextProducerAttempt) {
+		return nil, errors.New("kafka producer unavailable; next attempt at " + nextProducerAttempt.String())
+	}
+	producer, err = InitProducer()
+	if err != nil {
+		producer = nil
+		ReportHealth(HealthKafkaProducer, true, err)
+		if GetKafkaErrorPolicy() == KafkaErrorsFatal {
+			log.Fatal("error in InitProducer()", err)
+		}
+		nextProducerAttempt = time.Now().Add(producerBackoff.Next())
+		return nil, err
+	}
+	producerBackoff.Reset()
+	ReportHealth(HealthKafkaProducer, true, nil)
+	return producer, nil
+}
+
+//attached to commands to correlate producer errors with their camunda task
+type commandMetadata struct {
+	TaskId  string
+	Attempt int64
+}
+
+func Produce(topic string, message string) (err error) {
+	return produceMessage(&sarama.ProducerMessage{Topic: topic, Key: nil, Value: sarama.StringEncoder(message)})
+}
+
+//returns after the broker acknowledged the message (at least KafkaRequiredAcks = local); used for messages that may not get lost silently
+func ProduceSync(topic string, message string) (err error) {
+	p, err := getSyncProducer()
 	if err != nil {
-		log.Fatal("error in kazoo.NewKazooFromConnectionString()", err)
+		log.Println("ERROR: unable to produce kafka msg", topic, err)
+		return err
 	}
-	broker, err := kz.BrokerList()
-	kz.Close()
+	_, _, err = p.SendMessage(&sarama.ProducerMessage{Topic: topic, Value: sarama.StringEncoder(message), Timestamp: time.Now()})
+	if err != nil {
+		KafkaProduced.WithLabelValues("error").Inc()
+		return err
+	}
+	KafkaProduced.WithLabelValues("success").Inc()
+	return nil
+}
+
+//like getProducer for the sync producer
+func getSyncProducer() (result sarama.SyncProducer, err error) {
+	syncProducerMux.Lock()
+	defer syncProducerMux.Unlock()
+	if syncProducer != nil {
+		return syncProducer, nil
+	}
+	if syncProducerBackoff == nil {
+		syncProducerBackoff = NewKafkaReconnectBackoff()
+	}
+	if time.Now().Before(nextSyncProducerAttempt) {
+		return nil, errors.New("sync kafka producer unavailable; next attempt at " + nextSyncProducerAttempt.String())
+	}
+	syncProducer, err = initSyncProducer()
+	if err != nil {
+		syncProducer = nil
+		ReportHealth(HealthKafkaProducer, true, err)
+		if GetKafkaErrorPolicy() == KafkaErrorsFatal {
+			log.Fatal("error in initSyncProducer()", err)
+		}
+		nextSyncProducerAttempt = time.Now().Add(syncProducerBackoff.Next())
+		return nil, err
+	}
+	syncProducerBackoff.Reset()
+	ReportHealth(HealthKafkaProducer, true, nil)
+	return syncProducer, nil
+}
 
+func initSyncProducer() (result sarama.SyncProducer, err error) {
+	broker, err := GetBrokerList()
 	if err != nil {
-		log.Fatal("error in kz.BrokerList()", err)
+		return result, err
+	}
+	config, err := NewKafkaProducerConfig()
+	if err != nil {
+		return result, err
+	}
+	if config.Producer.RequiredAcks == sarama.NoResponse {
+		config.Producer.RequiredAcks = sarama.WaitForLocal
+	}
+	config.Producer.Flush.Frequency = 0
+	config.Producer.Flush.Messages = 0
+	return sarama.NewSyncProducer(broker, config)
+}
+
+//produces the command of a camunda task; if the message can not be published, the task fails (see handleProducerError)
+func ProduceCommand(taskId string, command CommandMessage) (err error) {
+	msg := &sarama.ProducerMessage{Topic: command.Topic, Key: nil, Value: sarama.StringEncoder(command.Value), Metadata: commandMetadata{TaskId: taskId}}
+	if command.Key != "" {
+		msg.Key = sarama.StringEncoder(command.Key)
+	}
+	if !kafkaHeadersSupported() {
+		return produceMessage(msg)
+	}
+	for key, value := range command.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
 	}
+	return produceMessage(msg)
+}
 
-	sarama_conf := sarama.NewConfig()
-	sarama_conf.Version = sarama.V0_10_0_1
-	producer, err = sarama.NewAsyncProducer(broker, sarama_conf)
+func produceMessage(msg *sarama.ProducerMessage) (err error) {
+	p, err := getProducer()
 	if err != nil {
-		log.Fatal("error in sarama.NewAsyncProducer()", broker, err)
+		log.Println("ERROR: unable to produce kafka msg", msg.Topic, err)
+		return err
+	}
+	if msg.Value != sarama.StringEncoder("topic_init") {
+		log.Println("produce kafka msg: ", msg.Topic, msg.Value)
 	}
-	return producer
+	msg.Timestamp = time.Now()
+	p.Input() <- msg
+	return nil
 }
 
-func Produce(topic string, message string) {
-	onceProducer.Do(func() {
-		producer = InitProducer()
+//commands are published again up to KafkaProduceRetries times; afterwards the task fails
+//errors of single messages are only counted; the producer is critical if it can not be initialized (see getProducer)
+func handleProducerError(err *sarama.ProducerError) {
+	log.Println("ERROR: unable to produce kafka message", err)
+	KafkaProduced.WithLabelValues("error").Inc()
+	metadata, ok := err.Msg.Metadata.(commandMetadata)
+	if !ok {
+		return
+	}
+	if metadata.Attempt >= util.Config.KafkaProduceRetries {
+		failCommand(metadata.TaskId, err.Err)
+		return
+	}
+	if _, ok := GetInFlightRegistry().Get(metadata.TaskId); !ok {
+		return
+	}
+	metadata.Attempt++
+	retry := &sarama.ProducerMessage{Topic: err.Msg.Topic, Key: err.Msg.Key, Value: err.Msg.Value, Headers: err.Msg.Headers, Metadata: metadata}
+	time.AfterFunc(time.Duration(util.Config.KafkaProduceRetryBackoff)*time.Millisecond, func() {
+		KafkaProduced.WithLabelValues("retry").Inc()
+		if err := produceMessage(retry); err != nil {
+			failCommand(metadata.TaskId, err)
+		}
 	})
-	if message != "topic_init" {
-		log.Println("produce kafka msg: ", topic, message)
+}
+
+//the command could not be published; the task is handed back to camunda according to the retry policy
+func failCommand(taskId string, err error) {
+	inFlightTask, ok := GetInFlightRegistry().Close(taskId)
+	if !ok {
+		return //already answered or expired
 	}
-	producer.Input() <- &sarama.ProducerMessage{Topic: topic, Key: nil, Value: sarama.StringEncoder(message), Timestamp: time.Now()}
+	HandleTaskError(inFlightTask.Task, NewTaskError(ErrorClassUnavailable, "unable to send command: "+err.Error()))
 }
 
+//flushes buffered messages; does nothing if no message has been produced
 func CloseProducer() {
-	onceProducer.Do(func() {
-		producer = InitProducer()
-	})
-	producer.Close()
+	producerMux.Lock()
+	defer producerMux.Unlock()
+	if producer != nil {
+		err := producer.Close()
+		if err != nil {
+			log.Println("ERROR: while closing producer", err)
+		}
+		producer = nil
+	}
+	syncProducerMux.Lock()
+	defer syncProducerMux.Unlock()
+	if syncProducer != nil {
+		err := syncProducer.Close()
+		if err != nil {
+			log.Println("ERROR: while closing sync producer", err)
+		}
+		syncProducer = nil
+	}
 }
@@ -0,0 +1,150 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+	"github.com/Shopify/sarama"
+)
+
+func TestProducerErrorFailsTask(t *testing.T) {
+	mux := sync.Mutex{}
+	failures := []string{}
+	camunda := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		failures = append(failures, request.URL.Path)
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	defer camunda.Close()
+
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("protocol", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(2).SetError("protocol", 0, sarama.ErrMessageSizeTooLarge),
+	})
+
+	util.Config = &util.ConfigStruct{
+		CamundaUrl:               camunda.URL,
+		KafkaBootstrap:           broker.Addr(),
+		KafkaProduceRetries:      1,
+		KafkaProduceRetryBackoff: 10,
+		CamundaRetries:           3,
+	}
+	defer CloseProducer()
+	healthMux.Lock()
+	healthChecks = map[string]HealthCheck{}
+	healthMux.Unlock()
+
+	GetInFlightRegistry().Add(InFlightTask{Task: messages.CamundaTask{Id: "task1"}, Deadline: time.Now().Add(time.Minute)})
+	err := ProduceCommand("task1", CommandMessage{Topic: "protocol", Key: "device1", Headers: map[string]string{HeaderTaskId: "task1"}, Value: "command"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := GetInFlightRegistry().Get("task1"); !ok {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, ok := GetInFlightRegistry().Get("task1"); ok {
+		t.Fatal("task still in flight")
+	}
+	produceRequests := 0
+	for _, req := range broker.History() {
+		if _, ok := req.Request.(*sarama.ProduceRequest); ok {
+			produceRequests++
+		}
+	}
+	if produceRequests != 2 {
+		t.Fatal("expected one retry of the command", produceRequests)
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if len(failures) != 1 || failures[0] != "/external-task/task1/failure" {
+		t.Fatal(failures)
+	}
+
+	//a rejected message does not pause the camunda worker
+	if !CriticalDependenciesUp() {
+		t.Fatal("produce error reported as critical", GetHealthReport())
+	}
+}
+
+func TestProduceSyncDoesNotBlockCommands(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("protocol", 0, broker.BrokerID()).
+			SetLeader("dlq", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(2),
+	})
+	util.Config = &util.ConfigStruct{KafkaBootstrap: broker.Addr(), KafkaReconnectBackoff: 60000, KafkaReconnectMaxBackoff: 60000}
+	defer CloseProducer()
+	if _, err := getProducer(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a slow dead letter publish does not hold the command producer
+	broker.SetLatency(time.Second)
+	syncDone := make(chan error, 1)
+	go func() {
+		syncDone <- ProduceSync("dlq", "dead letter")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if err := ProduceCommand("task1", CommandMessage{Topic: "protocol", Value: "command"}); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatal("command blocked by sync producer", time.Since(start))
+	}
+	if err := <-syncDone; err != nil {
+		t.Fatal(err)
+	}
+	broker.SetLatency(0)
+
+	//an unreachable broker is not contacted again before the reconnect backoff passed
+	CloseProducer()
+	util.Config.KafkaBootstrap = "127.0.0.1:1"
+	if err := ProduceSync("dlq", "dead letter"); err == nil {
+		t.Fatal("expected error")
+	}
+	start = time.Now()
+	if err := ProduceSync("dlq", "dead letter"); err == nil || time.Since(start) > 100*time.Millisecond {
+		t.Fatal("reconnect backoff not applied", err, time.Since(start))
+	}
+	syncProducerMux.Lock()
+	nextSyncProducerAttempt = time.Time{}
+	syncProducerBackoff = nil
+	syncProducerMux.Unlock()
+	healthMux.Lock()
+	healthChecks = map[string]HealthCheck{}
+	healthMux.Unlock()
+}
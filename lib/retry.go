@@ -0,0 +1,70 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+//number of retries after the first failure for the given error class
+func GetMaxRetries(class string) int64 {
+	if override, ok := util.Config.CamundaRetryOverrides[class]; ok {
+		retries, err := strconv.ParseInt(override, 10, 64)
+		if err == nil {
+			return retries
+		}
+	}
+	return util.Config.CamundaRetries
+}
+
+//camunda returns null retries until the first failure; remaining counts the current attempt
+//returns the retries for the failure request and the retryTimeout in ms
+func GetRetryPolicy(class string, taskRetries *int64) (retries int64, retryTimeout int64) {
+	max := GetMaxRetries(class)
+	if max <= 0 {
+		return 0, 0
+	}
+	remaining := max + 1
+	if taskRetries != nil && *taskRetries < remaining {
+		remaining = *taskRetries
+	}
+	retries = remaining - 1
+	if retries <= 0 {
+		return 0, 0
+	}
+	attempt := max + 1 - remaining
+	return retries, getRetryTimeout(attempt)
+}
+
+//exponential backoff with jitter, limited by CamundaRetryMaxTimeout
+func getRetryTimeout(attempt int64) int64 {
+	timeout := float64(util.Config.CamundaRetryTimeout) * math.Pow(2, float64(attempt))
+	if util.Config.CamundaRetryMaxTimeout > 0 && timeout > float64(util.Config.CamundaRetryMaxTimeout) {
+		timeout = float64(util.Config.CamundaRetryMaxTimeout)
+	}
+	if util.Config.CamundaRetryJitter > 0 {
+		timeout = timeout + timeout*util.Config.CamundaRetryJitter*(2*rand.Float64()-1)
+	}
+	if timeout < 0 {
+		return 0
+	}
+	return int64(timeout)
+}
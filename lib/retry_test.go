@@ -0,0 +1,54 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	util.Config = &util.ConfigStruct{
+		CamundaRetries:         3,
+		CamundaRetryTimeout:    1000,
+		CamundaRetryMaxTimeout: 3000,
+		CamundaRetryOverrides:  map[string]string{ErrorClassInvalidPayload: "0", ErrorClassUnavailable: "5"},
+	}
+	var taskRetries *int64
+	expectedTimeouts := []int64{1000, 2000, 3000}
+	for i, expectedTimeout := range expectedTimeouts {
+		retries, timeout := GetRetryPolicy(ErrorClassProtocolError, taskRetries)
+		if retries != int64(3-i) || timeout != expectedTimeout {
+			t.Fatal(i, retries, timeout)
+		}
+		taskRetries = &retries
+	}
+	retries, timeout := GetRetryPolicy(ErrorClassProtocolError, taskRetries)
+	if retries != 0 || timeout != 0 {
+		t.Fatal(retries, timeout)
+	}
+
+	retries, _ = GetRetryPolicy(ErrorClassInvalidPayload, nil)
+	if retries != 0 {
+		t.Fatal(retries)
+	}
+	retries, _ = GetRetryPolicy(ErrorClassUnavailable, nil)
+	if retries != 5 {
+		t.Fatal(retries)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"log"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+//waits until all in-flight tasks received their response or the grace period is over
+func DrainInFlightTasks(gracePeriod time.Duration) {
+	registry := GetInFlightRegistry()
+	deadline := time.Now().Add(gracePeriod)
+	for registry.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+//releases the locks of all remaining in-flight tasks so that camunda hands them out again;
+//with QosStrategy "<=" the commands may already have been executed: these tasks keep their lock and stay in the in-flight store,
+//camunda hands them out after the lock expired and they fail with a timeout because of their sent marker
+func UnlockInFlightTasks() {
+	registry := GetInFlightRegistry()
+	for _, task := range registry.List() {
+		if util.Config.QosStrategy == "<=" {
+			log.Println("WARNING: keep lock of pending task; its command may have been executed", task.Task.Id)
+			continue
+		}
+		log.Println("unlock pending task", task.Task.Id)
+		if err := UnlockCamundaTask(task.Task.Id); err != nil && !IsCamundaTaskNotFound(err) {
+			log.Println("ERROR: unable to unlock task", task.Task.Id, err)
+		}
+		registry.Close(task.Task.Id)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestShutdownInFlightTasks(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl}
+	registry := GetInFlightRegistry()
+
+	//the response arrives within the grace period
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "answered"}})
+	time.AfterFunc(200*time.Millisecond, func() {
+		registry.Resolve("answered")
+	})
+	start := time.Now()
+	DrainInFlightTasks(5 * time.Second)
+	if registry.Len() != 0 || time.Since(start) > 2*time.Second {
+		t.Fatal("drain did not return after the last response", registry.Len(), time.Since(start))
+	}
+
+	//the grace period ends: pending tasks are unlocked, unknown tasks are ignored
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "pending"}})
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "unknown"}})
+	engine.Lock(messages.CamundaTask{Id: "pending"}, GetWorkerId())
+	start = time.Now()
+	DrainInFlightTasks(300 * time.Millisecond)
+	if registry.Len() != 2 || time.Since(start) < 300*time.Millisecond {
+		t.Fatal("drain returned before the grace period ended", registry.Len(), time.Since(start))
+	}
+	UnlockInFlightTasks()
+	if registry.Len() != 0 {
+		t.Fatal(registry.List())
+	}
+	if engine.Locked("pending") || engine.Get("/external-task/pending/unlock") != 1 || engine.Get("/external-task/unknown/unlock") != 1 {
+		t.Fatal("pending task not unlocked")
+	}
+
+	//at most once: the command may have been executed, so the task is neither unlocked nor removed from the store
+	util.Config.QosStrategy = "<="
+	registry.Add(InFlightTask{Task: messages.CamundaTask{Id: "sent"}})
+	defer registry.Close("sent")
+	engine.Lock(messages.CamundaTask{Id: "sent"}, GetWorkerId())
+	UnlockInFlightTasks()
+	if _, ok := registry.Get("sent"); !ok || !engine.Locked("sent") || engine.Get("/external-task/sent/unlock") != 0 {
+		t.Fatal("sent task unlocked")
+	}
+}
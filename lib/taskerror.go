@@ -0,0 +1,84 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+//error classes used as keys in util.Config.BpmnErrorCodes
+const (
+	ErrorClassUnknownDevice  = "unknown_device"
+	ErrorClassAccessDenied   = "access_denied"
+	ErrorClassProtocolError  = "protocol_error"
+	ErrorClassInvalidPayload = "invalid_payload"
+	ErrorClassUnavailable    = "unavailable" //device repository, permission search or keycloak not reachable
+	ErrorClassTimeout        = "timeout"
+	ErrorClassInternal       = "internal"
+)
+
+type TaskError struct {
+	Class string
+	Msg   string
+	Final bool //never retried, regardless of the retry policy
+}
+
+func (this TaskError) Error() string {
+	return this.Msg
+}
+
+func NewTaskError(class string, msg string) TaskError {
+	return TaskError{Class: class, Msg: msg}
+}
+
+func NewFinalTaskError(class string, msg string) TaskError {
+	return TaskError{Class: class, Msg: msg, Final: true}
+}
+
+func GetErrorClass(err error) string {
+	if taskErr, ok := err.(TaskError); ok {
+		return taskErr.Class
+	}
+	return ErrorClassInternal
+}
+
+func isFinal(err error) bool {
+	taskErr, ok := err.(TaskError)
+	return ok && taskErr.Final
+}
+
+//sends a bpmn error if util.Config.BpmnErrorCodes contains a code for the error class;
+//else a failure with retries as defined by the retry policy; camunda raises an incident when no retries are left
+func HandleTaskError(task messages.CamundaTask, err error) {
+	class := GetErrorClass(err)
+	countTaskFailure(task.TopicName, class)
+	code, ok := util.Config.BpmnErrorCodes[class]
+	if !ok || code == "" {
+		if isFinal(err) {
+			CamundaError(task, err.Error())
+		} else {
+			CamundaRetryableError(task, class, err.Error())
+		}
+		return
+	}
+	variables := map[string]messages.CamundaOutput{}
+	if util.Config.BpmnErrorVariable != "" {
+		variables[util.Config.BpmnErrorVariable] = messages.CamundaOutput{Value: messages.BpmnMsg{ErrorMsg: err.Error()}}
+	}
+	CamundaBpmnError(task, code, err.Error(), variables)
+}
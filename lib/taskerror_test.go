@@ -0,0 +1,92 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestGetErrorClass(t *testing.T) {
+	cases := []struct {
+		err   error
+		class string
+		final bool
+	}{
+		{NewTaskError(ErrorClassUnknownDevice, "unknown"), ErrorClassUnknownDevice, false},
+		{NewFinalTaskError(ErrorClassTimeout, "timeout"), ErrorClassTimeout, true},
+		{errors.New("foo"), ErrorClassInternal, false},
+		{nil, ErrorClassInternal, false},
+	}
+	for i, c := range cases {
+		if class := GetErrorClass(c.err); class != c.class {
+			t.Fatal(i, class)
+		}
+		if isFinal(c.err) != c.final {
+			t.Fatal(i, "unexpected final flag")
+		}
+	}
+}
+
+func TestHandleTaskError(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{
+		CamundaUrl:          camundaUrl,
+		CamundaRetries:      3,
+		CamundaRetryTimeout: 1000,
+		BpmnErrorCodes:      map[string]string{ErrorClassUnknownDevice: "device_not_found", ErrorClassAccessDenied: ""},
+		BpmnErrorVariable:   "error",
+	}
+	one := int64(1)
+	cases := []struct {
+		name         string
+		retries      *int64
+		err          error
+		bpmnError    string //expected code; empty = failure expected
+		failureRetry int64
+		retryTimeout int64
+	}{
+		{"mapped class", nil, NewTaskError(ErrorClassUnknownDevice, "unknown device"), "device_not_found", 0, 0},
+		{"mapped final", nil, NewFinalTaskError(ErrorClassUnknownDevice, "unknown device"), "device_not_found", 0, 0},
+		{"empty code", nil, NewTaskError(ErrorClassAccessDenied, "access denied"), "", 3, 1000},
+		{"retryable", nil, NewTaskError(ErrorClassProtocolError, "device offline"), "", 3, 1000},
+		{"last retry", &one, NewTaskError(ErrorClassProtocolError, "device offline"), "", 0, 0},
+		{"final", nil, NewFinalTaskError(ErrorClassTimeout, "communication timeout"), "", 0, 0},
+		{"internal", nil, errors.New("foo"), "", 3, 1000},
+	}
+	for i, c := range cases {
+		task := messages.CamundaTask{Id: "task" + strconv.Itoa(i), Retries: c.retries}
+		engine.Lock(task, GetWorkerId())
+		HandleTaskError(task, c.err)
+		bpmnError, isBpmnError := engine.BpmnError(task.Id)
+		failure, isFailure := engine.Failure(task.Id)
+		if c.bpmnError != "" {
+			if !isBpmnError || isFailure || bpmnError.ErrorCode != c.bpmnError || bpmnError.Variables["error"].Value.ErrorMsg != c.err.Error() {
+				t.Fatal(c.name, bpmnError, failure)
+			}
+			continue
+		}
+		if !isFailure || isBpmnError || failure.Retries != c.failureRetry || failure.RetryTimeout != c.retryTimeout || failure.ErrorMessage != c.err.Error() {
+			t.Fatal(c.name, bpmnError, failure)
+		}
+	}
+}
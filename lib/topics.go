@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+type TopicHandler func(task messages.CamundaTask)
+
+type Topic struct {
+	Name         string
+	LockDuration int64    //ms
+	Variables    []string //variables camunda should return for a task of this topic; nil returns all
+	Handler      TopicHandler
+}
+
+var topics = map[string]Topic{}
+var topicsMux sync.RWMutex
+
+//registers a topic for the fetch loop; an already registered topic with the same name is replaced
+func RegisterTopic(topic Topic) {
+	topicsMux.Lock()
+	defer topicsMux.Unlock()
+	if topic.LockDuration <= 0 {
+		topic.LockDuration = util.Config.CamundaFetchLockDuration
+	}
+	topics[topic.Name] = topic
+}
+
+func UnregisterTopic(name string) {
+	topicsMux.Lock()
+	defer topicsMux.Unlock()
+	delete(topics, name)
+}
+
+func GetTopic(name string) (topic Topic, ok bool) {
+	topicsMux.RLock()
+	defer topicsMux.RUnlock()
+	topic, ok = topics[name]
+	return
+}
+
+func GetTopics() (result []Topic) {
+	topicsMux.RLock()
+	defer topicsMux.RUnlock()
+	for _, topic := range topics {
+		result = append(result, topic)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return
+}
+
+//the device command topic is handled by ExecuteCamundaTask
+func RegisterDeviceCommandTopic() {
+	if util.Config.CamundaTopic == "" {
+		return
+	}
+	if _, ok := GetTopic(util.Config.CamundaTopic); ok {
+		return
+	}
+	RegisterTopic(Topic{
+		Name:         util.Config.CamundaTopic,
+		LockDuration: util.Config.CamundaFetchLockDuration,
+		Handler:      ExecuteCamundaTask,
+	})
+}
+
+func getFetchTopics() (result []messages.CamundaTopic) {
+	for _, topic := range GetTopics() {
+		result = append(result, messages.CamundaTopic{Name: topic.Name, LockDuration: topic.LockDuration, Variables: topic.Variables})
+	}
+	return
+}
+
+func HandleCamundaTask(task messages.CamundaTask) {
+	topic, ok := GetTopic(task.TopicName)
+	if !ok || topic.Handler == nil {
+		log.Println("ERROR: no handler registered for topic", task.TopicName)
+		countTaskFailure(task.TopicName, ErrorClassInternal)
+		CamundaError(task, "no handler registered for topic "+task.TopicName)
+		return
+	}
+	TasksExecuted.WithLabelValues(task.TopicName).Inc()
+	topic.Handler(task)
+}
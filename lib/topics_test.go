@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/SENERGY-Platform/external-task-worker/lib/messages"
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestTopics(t *testing.T) {
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+	util.Config = &util.ConfigStruct{CamundaUrl: camundaUrl, CamundaWorkerTasks: 10, CamundaFetchLockDuration: 10000}
+	defer UnregisterTopic("topic1")
+	defer UnregisterTopic("topic2")
+
+	handled := map[string]string{}
+	RegisterTopic(Topic{Name: "topic1", Handler: func(task messages.CamundaTask) {
+		handled[task.Id] = "topic1"
+	}})
+	RegisterTopic(Topic{Name: "topic2", LockDuration: 2000, Variables: []string{"payload"}, Handler: func(task messages.CamundaTask) {
+		handled[task.Id] = "topic2"
+	}})
+
+	engine.Queue(
+		messages.CamundaTask{Id: "task1", TopicName: "topic1"},
+		messages.CamundaTask{Id: "task2", TopicName: "topic2"},
+		messages.CamundaTask{Id: "task3", TopicName: "unknown"},
+	)
+	tasks, err := GetCamundaTask(context.Background())
+	if err != nil || len(tasks) != 3 {
+		t.Fatal(tasks, err)
+	}
+	fetches := engine.Fetches()
+	expected := []messages.CamundaTopic{
+		{Name: "topic1", LockDuration: 10000},
+		{Name: "topic2", LockDuration: 2000, Variables: []string{"payload"}},
+	}
+	if len(fetches) != 1 || !reflect.DeepEqual(fetches[0].Topics, expected) {
+		t.Fatal("unexpected fetch topics", fetches)
+	}
+
+	for _, task := range tasks {
+		HandleCamundaTask(task)
+	}
+	if !reflect.DeepEqual(handled, map[string]string{"task1": "topic1", "task2": "topic2"}) {
+		t.Fatal("unexpected handler calls", handled)
+	}
+	failure, ok := engine.Failure("task3")
+	if !ok || failure.Retries != 0 || failure.ErrorMessage != "no handler registered for topic unknown" {
+		t.Fatal("missing failure for unknown topic", failure)
+	}
+
+	//replaced and removed topics
+	RegisterTopic(Topic{Name: "topic2", LockDuration: 3000})
+	UnregisterTopic("topic1")
+	if topics := getFetchTopics(); !reflect.DeepEqual(topics, []messages.CamundaTopic{{Name: "topic2", LockDuration: 3000}}) {
+		t.Fatal(topics)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+//carries commands to the protocol handlers and their responses back to the worker
+type Transport interface {
+	//publishes a message; taskId is empty for messages that do not belong to a camunda task (e.g. dead letters),
+	//these return after the message has been acknowledged
+	//if a command can not be delivered later on, the transport fails its in-flight task
+	Publish(taskId string, command CommandMessage) error
+
+	//delivers responses to handler until ctx is done; responses for which handler returns an error are delivered again
+	Subscribe(ctx context.Context, handler ResponseHandler)
+
+	//nil if commands can be published and responses are received
+	Health() error
+
+	//flushes pending messages
+	Close()
+}
+
+//response of a protocol handler; Topic, Partition and Offset locate it in the transport
+type Response struct {
+	Value     string
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+//returns nil if the response is done: camunda acknowledged the result, the failure has been reported
+//or the response is invalid (and moved to the dead letter topic); otherwise the response has to be delivered again
+type ResponseHandler func(response Response) error
+
+var transport Transport = KafkaTransport{}
+
+//kafka is the default transport; cache invalidation and dead letter replays depend on it as well
+func IsKafkaTransport() bool {
+	return util.Config.Transport == "" || util.Config.Transport == "kafka"
+}
+
+//selects the transport of util.Config.Transport
+func InitTransport() error {
+	switch util.Config.Transport {
+	case "", "kafka":
+		SetTransport(KafkaTransport{})
+	case "memory":
+		log.Println("WARNING: use memory transport; commands are answered by an echo")
+		SetTransport(NewMemoryTransport(EchoResponder))
+	case "mqtt":
+		mqtt, err := NewMqttTransport()
+		if err != nil {
+			return err
+		}
+		SetTransport(mqtt)
+	default:
+		return errors.New("unknown Transport " + util.Config.Transport)
+	}
+	return nil
+}
+
+func GetTransport() Transport {
+	return transport
+}
+
+func SetTransport(t Transport) {
+	transport = t
+}
+
+func HandleResponse(response Response) (err error) {
+	err = CompleteCamundaTask(response.Value)
+	if err == nil {
+		return nil
+	}
+	log.Println("error while processing response", err, response.Value)
+	if _, ok := err.(InvalidResponseError); ok {
+		if util.Config.DeadLetterTopic == "" {
+			log.Println("WARNING: drop invalid response; no DeadLetterTopic configured")
+			return nil
+		}
+		err = PublishDeadLetter(response, err)
+		if err != nil {
+			log.Println("ERROR: unable to publish dead letter", err)
+		}
+	}
+	return err
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2019 InfAI (CC SES)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/SENERGY-Platform/external-task-worker/util"
+)
+
+func TestMemoryTransportFlow(t *testing.T) {
+	drcloser, deviceRepoUrl, _ := DeviceRepoMock()
+	defer drcloser()
+	authcloser, authUrl, _ := AuthMock()
+	defer authcloser()
+	permcloser, permUrl, _ := PermsearchMock()
+	defer permcloser()
+	camundacloser, camundaUrl, engine := CamundaMock()
+	defer camundacloser()
+
+	util.Config = &util.ConfigStruct{
+		CamundaUrl:               camundaUrl,
+		CamundaTopic:             "command",
+		CamundaFetchLockDuration: 60000,
+		CamundaWorkerTasks:       10,
+		DeviceRepoUrl:            deviceRepoUrl,
+		AuthEndpoint:             authUrl,
+		PermissionsUrl:           permUrl,
+		QosStrategy:              ">=",
+	}
+	memory := NewMemoryTransport(EchoResponder)
+	SetTransport(memory)
+	defer SetTransport(KafkaTransport{})
+	defer UnregisterTopic("command")
+	RegisterDeviceCommandTopic()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go memory.Subscribe(ctx, HandleResponse)
+
+	engine.Queue(testCommandTask("task1", "device1"))
+	ExecuteNextCamundaTask(ctx)
+
+	published := memory.Published()
+	if len(published) != 1 || published[0].Topic != "protocol1" || published[0].Key != "device1" || published[0].Headers[HeaderTaskId] != "task1" {
+		t.Fatal(published)
+	}
+	completion, ok := engine.Completion("task1")
+	for i := 0; i < 50 && !ok; i++ {
+		time.Sleep(20 * time.Millisecond)
+		completion, ok = engine.Completion("task1")
+	}
+	if !ok || completion.WorkerId != GetWorkerId() {
+		t.Fatal(completion)
+	}
+	if GetInFlightRegistry().Len() != 0 {
+		t.Fatal(GetInFlightRegistry().List())
+	}
+}
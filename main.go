@@ -17,12 +17,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"math/rand"
 	"os"
 	"os/signal"
 
 	"syscall"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/SENERGY-Platform/external-task-worker/lib"
@@ -32,6 +35,8 @@ import (
 func main() {
 
 	configLocation := flag.String("config", "config.json", "configuration file")
+	replayDeadLetters := flag.Bool("replay-dlq", false, "replays the responses of DeadLetterTopic and exits")
+	replayOffset := flag.Int64("replay-dlq-offset", sarama.OffsetOldest, "first offset of every partition to replay")
 	flag.Parse()
 
 	err := util.LoadConfig(*configLocation)
@@ -39,15 +44,76 @@ func main() {
 		log.Fatal(err)
 	}
 
+	rand.Seed(time.Now().UnixNano())
+
+	if lib.IsKafkaTransport() || *replayDeadLetters {
+		err = lib.ValidateKafkaConfig()
+		if err != nil {
+			log.Fatal("invalid kafka config: ", err)
+		}
+	}
+
 	if util.Config.SaramaLog == "true" {
 		sarama.Logger = log.New(os.Stderr, "[Sarama] ", log.LstdFlags)
 	}
 
-	go lib.CamundaWorker()
-	go lib.InitConsumer()
+	if *replayDeadLetters {
+		replayed, failed, err := lib.ReplayDeadLetters(*replayOffset)
+		if err != nil {
+			log.Fatal("unable to replay dead letters: ", err)
+		}
+		log.Println("replayed dead letters:", replayed, "failed:", failed)
+		return
+	}
+
+	if util.Config.WorkerId != "" {
+		lib.SetWorkerId(util.Config.WorkerId)
+	}
+	err = lib.InitInFlightStore()
+	if err != nil {
+		log.Fatal("unable to init in-flight store: ", err)
+	}
+	defer lib.CloseInFlightStore()
+
+	err = lib.InitTransport()
+	if err != nil {
+		log.Fatal("unable to init transport: ", err)
+	}
+
+	server := lib.StartApiServer()
+
+	ctx, stop := context.WithCancel(context.Background())
+	fetchCtx, stopFetching := context.WithCancel(ctx)
+
+	workerDone := make(chan bool)
+	go func() {
+		lib.CamundaWorker(fetchCtx)
+		close(workerDone)
+	}()
+	consumerDone := make(chan bool)
+	go func() {
+		lib.GetTransport().Subscribe(ctx, lib.HandleResponse)
+		close(consumerDone)
+	}()
+	if lib.IsKafkaTransport() {
+		go lib.InitCacheInvalidation(ctx)
+	}
+	go lib.InFlightSupervisor(ctx)
+	go lib.HealthMonitor(ctx)
 
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	sig := <-shutdown
 	log.Println("received shutdown signal", sig)
+
+	stopFetching()
+	<-workerDone
+	log.Println("wait for pending responses")
+	lib.DrainInFlightTasks(time.Duration(util.Config.ShutdownGracePeriod) * time.Millisecond)
+	stop()
+	<-consumerDone
+	lib.UnlockInFlightTasks()
+	lib.GetTransport().Close()
+	server.Shutdown(context.Background())
+	log.Println("shutdown complete")
 }
@@ -32,15 +32,58 @@ type ConfigStruct struct {
 	CamundaWorkerTimeout     int64
 	CamundaWorkerTasks       int64
 	CamundaFetchLockDuration int64
+	CamundaLongPollTimeout   int64 //ms; 0 disables long polling
+	CamundaMaxExecutionTime  int64 //ms; locks of sent commands are extended until a response arrives or this time passes; 0 disables lock extension
+	CamundaLockExtensionInterval int64 //ms; defaults to half of the shortest lock duration of all topics; longer intervals are shortened to it
 	CamundaUrl               string
 	CamundaTopic             string
-	ZookeeperUrl             string //host1:2181,host2:2181/chroot
+	Transport                string //kafka (default), mqtt or memory (answers every command with an echo; for local development); kafka settings and cache invalidation are only used by kafka
+	MqttBroker               string //tcp://host:1883 or ssl://host:8883
+	MqttClientId             string //empty = WorkerId; required for persistent sessions (MqttCleanSession != "true") without WorkerId
+	MqttUser                 string
+	MqttPassword             string
+	MqttQos                  int64 //0, 1 or 2; used for commands and responses
+	MqttCleanSession         string //"true" drops the subscription and queued responses while the worker is disconnected
+	MqttCommandPrefix        string //commands are published to <prefix>/<protocolTopic>
+	MqttResponseTopic        string
+	MqttTlsCaFile            string //pem; empty = system roots
+	MqttTlsCertFile          string //pem client certificate
+	MqttTlsKeyFile           string //pem key of MqttTlsCertFile
+	KafkaBootstrap           string //host1:9092,host2:9092; uses broker-side consumer group offsets; empty = legacy zookeeper discovery
+	ZookeeperUrl             string //host1:2181,host2:2181/chroot; only used if KafkaBootstrap is empty
 	KafkaConsumerGroup       string
 	ResponseTopic            string
-	QosStrategy              string // <=, >=
+	DeadLetterTopic          string //receives responses that can not be processed; empty = drop them
+	QosStrategy              string // <= (at most once; sent commands are marked by the local execution variable command_sent), >=
+	AcceptForeignResponses   string //"true" completes tasks of other worker instances (replicas share KafkaConsumerGroup); camunda has to confirm the lock of the worker, the service is loaded from the task payload; "false" drops them
+	WorkerId                 string //camunda worker id; random if empty (persisted with InFlightStorePath)
+	InFlightStorePath        string //bbolt file for in-flight tasks; empty disables persistence
+	ShutdownGracePeriod      int64 //ms to wait for responses of in-flight tasks before their locks are released
+	ApiPort                  string //serves /metrics, /health/live and /health/ready
+	HealthCheckInterval      int64 //ms
 	KafkaTimeout             int64
 	SaramaLog                string
-	FatalKafkaErrors         string
+	FatalKafkaErrors         string //fatal, reconnect or ignore; "true" = fatal, "false" = ignore
+	KafkaReconnectBackoff    int64 //ms; doubled for every failed reconnect
+	KafkaReconnectMaxBackoff int64 //ms
+	KafkaVersion             string //e.g. 2.1.0; empty = 0.10.0.1 (0.10.2.0 for consumer groups of KafkaBootstrap); command headers (task and trace id) require 0.11.0
+	KafkaCompression         string //none, gzip, snappy, lz4 or zstd (requires KafkaVersion >= 2.1.0)
+	KafkaRequiredAcks        string //none, local or all; empty = local
+	KafkaIdempotent          string //"true" enables the idempotent producer; requires KafkaRequiredAcks = all and KafkaVersion >= 0.11
+	KafkaMaxMessageBytes     int64 //0 = sarama default (1000000)
+	KafkaFlushFrequency      int64 //ms; 0 = send as fast as possible
+	KafkaFlushMessages       int64 //batch size; 0 = no limit
+	KafkaMessageKey          string //device, service or none; empty = device
+	KafkaProduceRetries      int64 //additional publish attempts of a command after sarama gave up; afterwards the task fails
+	KafkaProduceRetryBackoff int64 //ms
+	KafkaTls                 string //"true" enables tls; implied by KafkaTlsCaFile and KafkaTlsCertFile
+	KafkaTlsCaFile           string //pem; empty = system roots
+	KafkaTlsCertFile         string //pem client certificate
+	KafkaTlsKeyFile          string //pem key of KafkaTlsCertFile
+	KafkaTlsSkipVerify       string //"true" disables the verification of the broker certificate
+	KafkaSaslMechanism       string //PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512; empty disables sasl
+	KafkaSaslUser            string
+	KafkaSaslPassword        string
 	AuthExpirationTimeBuffer float64
 	AuthEndpoint             string
 	AuthClientId             string
@@ -49,6 +92,22 @@ type ConfigStruct struct {
 	JwtExpiration            int64
 	JwtIssuer                string
 	PermissionsUrl           string
+	DeviceCacheExpiration     int64 //sec; 0 = 60 (L1Expiration)
+	ServiceCacheExpiration    int64 //sec; 0 = 60 (L1Expiration)
+	PermissionCacheExpiration int64 //sec; 0 = 60 (L1Expiration)
+	NegativeCacheExpiration   int64 //sec; used for unknown devices/services and denied access; 0 = not cached
+	DeviceChangeTopic         string //empty disables cache invalidation for devices
+	ServiceChangeTopic        string //empty disables cache invalidation for services
+	PermissionChangeTopic     string //empty disables cache invalidation for permissions
+	BpmnErrorCodes            map[string]string //error class -> bpmn error code; classes without code raise an incident
+	BpmnErrorVariable         string //process variable that receives the error message of a bpmn error
+	CamundaCompleteRetries    int64 //retries of camunda results (completion, failure, bpmn error) if camunda is unreachable or answers with a server error
+	CamundaCompleteRetryBackoff int64 //ms; doubled for every retry
+	CamundaRetries            int64 //retries after the first failure of a task
+	CamundaRetryTimeout       int64 //ms; doubled for every retry
+	CamundaRetryMaxTimeout    int64 //ms
+	CamundaRetryJitter        float64 //random deviation of the retry timeout; 0.2 = +-20%
+	CamundaRetryOverrides     map[string]string //error class -> retries
 }
 type ConfigType *ConfigStruct
 
@@ -74,7 +133,12 @@ func LoadConfig(location string) error {
 }
 
 func HandleDefaultValues(config ConfigType) {
-
+	if config.ApiPort == "" {
+		config.ApiPort = "8080"
+	}
+	if config.BpmnErrorVariable == "" {
+		config.BpmnErrorVariable = "error"
+	}
 }
 
 var camel = regexp.MustCompile("(^[^A-Z]*|[A-Z]*)([A-Z][^A-Z]+|$)")